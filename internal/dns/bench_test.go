@@ -0,0 +1,39 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+)
+
+// BenchmarkHandleCachedQuery measures the whole path of the query answered
+// from the cache: parsing, the cache lookup and serializing the response.
+func BenchmarkHandleCachedQuery(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newServer(ctx, ServerConfig{})
+	s.cache.Set([]types.Record{
+		{Domain: "www.example.com.", Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 3600, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 1)}},
+		{Domain: "www.example.com.", Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 3600, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 2)}},
+	})
+
+	query := constructQuery("www.example.com.", types.QuestionTypeA)
+	query.Header.RecursionDesired = true
+	query.Edns = &types.Edns{UdpPayloadSize: types.DefaultEdnsPayloadSize}
+	query.UpdateSectionSizes()
+	queryBytes := mustMarshal(b, query)
+	buf := make([]byte, types.DefaultEdnsPayloadSize)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		_, ok := s.handleQuery(ctx, queryBytes, "udp", buf)
+		if !ok {
+			b.Fatal("no response")
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package dns
+
+import (
+	"sync"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+)
+
+// packetBuffers keeps the buffers the packets are read into and written
+// to, so serving a query doesn't allocate them. The pool holds pointers,
+// since putting a slice into it would allocate.
+var packetBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, types.DefaultEdnsPayloadSize)
+		return &buf
+	},
+}
+
+func getBuffer() *[]byte {
+	return packetBuffers.Get().(*[]byte)
+}
+
+func putBuffer(buf *[]byte) {
+	packetBuffers.Put(buf)
+}
@@ -0,0 +1,334 @@
+package dns
+
+import (
+	"net"
+	"strings"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/cache"
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+)
+
+// cacheView is the way of reading the answers from the cache, either only
+// the fresh ones or the stale ones too.
+type cacheView struct {
+	get         func(key cache.RRsetKey) ([]types.Record, bool)
+	getNegative func(key cache.RRsetKey) (cache.NegativeAnswer, bool)
+}
+
+func freshView(c *cache.DnsCache) cacheView {
+	return cacheView{get: c.Get, getNegative: c.GetNegative}
+}
+
+func staleView(c *cache.DnsCache) cacheView {
+	return cacheView{get: c.GetStale, getNegative: c.GetNegativeStale}
+}
+
+// cachedResponse assembles the response from the cache. It returns the
+// last name in the CNAME chain and whether the response is complete, i.e.
+// contains either the requested RRset or the negative answer for it.
+func cachedResponse(c *cache.DnsCache, query types.Packet) (types.Packet, string, bool) {
+	return responseFrom(freshView(c), query)
+}
+
+// staleResponse assembles the response from the cache including the
+// expired records (RFC 8767), it's only used when the resolution fails.
+func staleResponse(c *cache.DnsCache, query types.Packet) (types.Packet, bool) {
+	response, _, complete := responseFrom(staleView(c), query)
+	return response, complete
+}
+
+// answersFrom assembles the answer from the cached RRsets following the
+// CNAMEs. It returns the last name in the chain and whether the RRset of
+// the requested type was found for it.
+func answersFrom(view cacheView, question types.Question) ([]types.Record, string, bool) {
+	var (
+		answers     = make([]types.Record, 0)
+		domain      = question.Domain
+		recordType  = types.RecordType(question.Type)
+		recordClass = types.RecordClass(question.Class)
+	)
+
+	for range maxCnameChainLength {
+		rrset, ok := view.get(cache.NewRRsetKey(domain, recordType, recordClass))
+		if ok && len(answers) == 0 {
+			// The cache returns a copy of the records, so there is no need
+			// to make another one.
+			return rrset, domain, true
+		}
+		if ok {
+			return append(answers, rrset...), domain, true
+		}
+
+		cnames, ok := view.get(cache.NewRRsetKey(domain, types.RecordTypeCNAME, recordClass))
+		if !ok {
+			break
+		}
+
+		answers = append(answers, cnames...)
+
+		cname, ok := getCname(cnames, domain)
+		if !ok {
+			break
+		}
+		domain = cname
+	}
+
+	return answers, domain, false
+}
+
+func responseFrom(view cacheView, query types.Packet) (types.Packet, string, bool) {
+	question := query.Questions[0]
+
+	answers, domain, complete := answersFrom(view, question)
+	if complete {
+		return constructResponse(query, types.PacketRecords{Answers: answers}), domain, true
+	}
+
+	key := cache.NewRRsetKey(domain, types.RecordType(question.Type), types.RecordClass(question.Class))
+	negative, ok := view.getNegative(key)
+	if !ok {
+		return constructResponse(query, types.PacketRecords{Answers: answers}), domain, false
+	}
+
+	packetRecords := types.PacketRecords{
+		Answers:          answers,
+		AuthorityRecords: []types.Record{negative.Soa},
+	}
+
+	response := constructResponse(query, packetRecords)
+	response.Header.ResponseCode = negative.ResponseCode
+	return response, domain, true
+}
+
+// sanitizeResponse drops the records the server can't be trusted with. The
+// server is only asked as a name server of the zone, so everything outside
+// of it is dropped (RFC 2181, section 5.4.1), along with the answers
+// unrelated to the question and the referrals that don't lead down the
+// tree towards the name. If the CNAME chain leaves the zone, the response
+// code and the authority section describe a name the server isn't
+// responsible for, so they are dropped and the target is looked up anew.
+func sanitizeResponse(question types.Question, zone string, response types.Packet) types.Packet {
+	chain := make(map[string]bool)
+	domain := question.Domain
+	for range maxCnameChainLength {
+		if !isSubdomain(domain, zone) {
+			break
+		}
+		chain[strings.ToLower(domain)] = true
+
+		cname, ok := getCname(response.Records.Answers, domain)
+		if !ok {
+			break
+		}
+		domain = cname
+	}
+
+	answers := make([]types.Record, 0, len(response.Records.Answers))
+	for _, record := range response.Records.Answers {
+		if chain[strings.ToLower(record.Domain)] {
+			answers = append(answers, record)
+		}
+	}
+
+	sanitized := response
+	sanitized.Records = types.PacketRecords{Answers: answers}
+
+	if !isSubdomain(domain, zone) {
+		if sanitized.Header.ResponseCode == types.ResponseCodeNameError {
+			sanitized.Header.ResponseCode = types.ResponseCodeNoError
+		}
+		sanitized.UpdateSectionSizes()
+		return sanitized
+	}
+
+	var (
+		authority  = make([]types.Record, 0)
+		delegation = ""
+	)
+
+	for _, record := range response.Records.AuthorityRecords {
+		switch record.Type {
+		case types.RecordTypeSOA:
+			if isSubdomain(domain, record.Domain) && isSubdomain(record.Domain, zone) {
+				authority = append(authority, record)
+			}
+		case types.RecordTypeNS:
+			below := isSubdomain(record.Domain, zone) && !isSubdomain(zone, record.Domain)
+			if !below || !isSubdomain(domain, record.Domain) {
+				continue
+			}
+
+			if delegation == "" || strings.EqualFold(record.Domain, delegation) {
+				delegation = record.Domain
+				authority = append(authority, record)
+			}
+		}
+	}
+
+	hosts := make(map[string]bool)
+	for _, host := range getNameServers(authority) {
+		hosts[strings.ToLower(host)] = true
+	}
+
+	glue := make([]types.Record, 0)
+	for _, record := range response.Records.AdditionalRecords {
+		isAddress := record.Type == types.RecordTypeA || record.Type == types.RecordTypeAAAA
+		if isAddress && hosts[strings.ToLower(record.Domain)] && isSubdomain(record.Domain, zone) {
+			glue = append(glue, record)
+		}
+	}
+
+	sanitized.Records.AuthorityRecords = authority
+	sanitized.Records.AdditionalRecords = glue
+	sanitized.UpdateSectionSizes()
+	return sanitized
+}
+
+// cacheResponse stores the answer RRsets relevant to the question, the
+// negative answers and the delegation data. The response is expected to be
+// sanitized, so it only has the records the server is responsible for.
+func cacheResponse(c *cache.DnsCache, question types.Question, response types.Packet) {
+	responseCode := response.Header.ResponseCode
+	if responseCode != types.ResponseCodeNoError && responseCode != types.ResponseCodeNameError {
+		return
+	}
+
+	chain := make(map[string]bool)
+	domain := question.Domain
+	for range maxCnameChainLength {
+		chain[strings.ToLower(domain)] = true
+
+		cname, ok := getCname(response.Records.Answers, domain)
+		if !ok {
+			break
+		}
+		domain = cname
+	}
+
+	answers := make([]types.Record, 0, len(response.Records.Answers))
+	for _, record := range response.Records.Answers {
+		if chain[strings.ToLower(record.Domain)] {
+			answers = append(answers, record)
+		}
+	}
+	c.Set(answers)
+
+	isNegative := responseCode == types.ResponseCodeNameError ||
+		(isNoData(response) && !hasAnswer(response.Records.Answers, domain, question))
+
+	if isNegative {
+		soa, ok := getSoa(response.Records.AuthorityRecords, domain)
+		if ok {
+			key := cache.NewRRsetKey(domain, types.RecordType(question.Type), types.RecordClass(question.Class))
+			c.SetNegative(key, cache.NegativeAnswer{ResponseCode: responseCode, Soa: soa})
+		}
+		return
+	}
+
+	delegation := make([]types.Record, 0)
+	for _, record := range response.Records.AuthorityRecords {
+		if record.Type == types.RecordTypeNS && isSubdomain(question.Domain, record.Domain) {
+			delegation = append(delegation, record)
+		}
+	}
+
+	if len(delegation) == 0 {
+		return
+	}
+
+	hosts := make(map[string]bool)
+	for _, host := range getNameServers(delegation) {
+		hosts[strings.ToLower(host)] = true
+	}
+
+	glue := make([]types.Record, 0)
+	for _, record := range response.Records.AdditionalRecords {
+		isAddress := record.Type == types.RecordTypeA || record.Type == types.RecordTypeAAAA
+		if isAddress && hosts[strings.ToLower(record.Domain)] {
+			glue = append(glue, record)
+		}
+	}
+
+	c.SetInfra(delegation)
+	c.SetInfra(glue)
+}
+
+// getSoa returns the SOA record of the zone the domain belongs to.
+func getSoa(records []types.Record, domain string) (types.Record, bool) {
+	for _, record := range records {
+		if record.Type == types.RecordTypeSOA && isSubdomain(domain, record.Domain) {
+			return record, true
+		}
+	}
+	return types.Record{}, false
+}
+
+// closestNameServers returns the servers of the closest enclosing zone
+// known from the cache along with the zone, falling back to the root
+// servers. The hosts inside the zone itself can't be looked up without the
+// glue, so the zone with nothing but such hosts is skipped in favor of its
+// parent.
+func closestNameServers(c *cache.DnsCache, domain string) (nameServers, string) {
+	for zone := domain; zone != ""; zone = parentDomain(zone) {
+		delegation, ok := c.GetInfra(cache.NewRRsetKey(zone, types.RecordTypeNS, types.RecordClassIN))
+		if !ok {
+			continue
+		}
+
+		var servers nameServers
+		for _, host := range getNameServers(delegation) {
+			addrs := cachedAddresses(c, host)
+			if len(addrs) > 0 {
+				servers.addrs = append(servers.addrs, addrs...)
+			} else if !isSubdomain(host, zone) {
+				servers.hosts = append(servers.hosts, host)
+			}
+		}
+
+		if len(servers.addrs) > 0 || len(servers.hosts) > 0 {
+			return servers, zone
+		}
+	}
+
+	return rootNameServers(), ""
+}
+
+// cachedAddresses returns the addresses of the host from both A and AAAA
+// RRsets. The authoritative answers are preferred to the glue (RFC 2181,
+// section 5.4.1).
+func cachedAddresses(c *cache.DnsCache, host string) []net.IP {
+	addrs := make([]net.IP, 0)
+	for _, recordType := range []types.RecordType{types.RecordTypeA, types.RecordTypeAAAA} {
+		key := cache.NewRRsetKey(host, recordType, types.RecordClassIN)
+
+		records, ok := c.Get(key)
+		if !ok {
+			records, ok = c.GetInfra(key)
+		}
+
+		if ok {
+			addrs = append(addrs, getAddresses(records, host)...)
+		}
+	}
+	return addrs
+}
+
+// isSubdomain reports whether the domain is equal to the zone or is
+// located under it, the root zone contains every domain.
+func isSubdomain(domain, zone string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+
+	if zone == "" {
+		return true
+	}
+	return domain == zone || strings.HasSuffix(domain, "."+zone)
+}
+
+func parentDomain(domain string) string {
+	index := strings.Index(domain, ".")
+	if index == -1 {
+		return ""
+	}
+	return domain[index+1:]
+}
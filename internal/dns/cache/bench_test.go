@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"testing"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+)
+
+// The benchmarks compare the single-shard cache (a global lock) with the
+// sharded one, run them with e.g. -cpu 1,2,4,8 to see how they scale.
+
+const benchmarkDomains = 4096
+
+func BenchmarkCacheGet(b *testing.B) {
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cache, keys := newBenchmarkCache(b, shards)
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := rand.IntN(len(keys))
+				for pb.Next() {
+					cache.Get(keys[i%len(keys)])
+					i += 1
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkCacheMixed(b *testing.B) {
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cache, keys := newBenchmarkCache(b, shards)
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := rand.IntN(len(keys))
+				for pb.Next() {
+					if i%10 == 0 {
+						cache.Set([]types.Record{benchmarkRecord(keys[i%len(keys)].Domain)})
+					} else {
+						cache.Get(keys[i%len(keys)])
+					}
+					i += 1
+				}
+			})
+		})
+	}
+}
+
+func newBenchmarkCache(b *testing.B, shards int) (*DnsCache, []RRsetKey) {
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Cleanup(cancel)
+
+	cache := NewDnsCache(ctx, Config{Shards: shards})
+
+	keys := make([]RRsetKey, benchmarkDomains)
+	for i := range keys {
+		domain := fmt.Sprintf("host%d.example.", i)
+		cache.Set([]types.Record{benchmarkRecord(domain)})
+		keys[i] = NewRRsetKey(domain, types.RecordTypeA, types.RecordClassIN)
+	}
+	return cache, keys
+}
+
+func benchmarkRecord(domain string) types.Record {
+	return types.Record{
+		Domain: domain,
+		Type:   types.RecordTypeA,
+		Class:  types.RecordClassIN,
+		Ttl:    300,
+		Data:   &types.ARData{IP: net.IPv4(192, 0, 2, 1)},
+	}
+}
@@ -2,85 +2,484 @@ package cache
 
 import (
 	"context"
-	"net"
+	"hash/maphash"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
 )
 
-type cacheRecord struct {
-	records   types.PacketRecords
-	expiresAt time.Time
+// RRsetKey identifies a set of records with the same owner, type and class
+// (RFC 2181, section 5). Domains are compared case-insensitively.
+type RRsetKey struct {
+	Domain string
+	Type   types.RecordType
+	Class  types.RecordClass
 }
 
-func newCacheRecord(packetRecords types.PacketRecords) cacheRecord {
-	ttl := time.Duration(minTtl(packetRecords)) * time.Second
-	expiresAt := time.Now().Add(ttl)
-	return cacheRecord{packetRecords, expiresAt}
+func NewRRsetKey(domain string, recordType types.RecordType, recordClass types.RecordClass) RRsetKey {
+	return RRsetKey{strings.ToLower(domain), recordType, recordClass}
 }
 
-type dnsCacheKey struct {
-	domain string
-	source string // IP in a string form
+const (
+	DefaultMaxTtl         = 24 * time.Hour
+	DefaultMaxNegativeTtl = 3 * time.Hour
+	DefaultMaxEntries     = 100_000
+	DefaultMaxBytes       = 64 << 20
+	DefaultShards         = 64
+	DefaultStaleWindow    = 24 * time.Hour
+	DefaultStaleTtl       = 30 * time.Second
+	DefaultPrefetchRatio  = 0.1
+	DefaultPrefetchHits   = 2
+	prefetchQueueSize     = 64
+)
+
+type Config struct {
+	// TTLs of the stored RRsets are raised to this value.
+	MinTtl time.Duration
+
+	// TTLs of the stored RRsets are lowered to this value,
+	// DefaultMaxTtl is used if the value is not positive.
+	MaxTtl time.Duration
+
+	// TTLs of the negative answers are lowered to this value,
+	// DefaultMaxNegativeTtl is used if the value is not positive.
+	MaxNegativeTtl time.Duration
+
+	// Upper bound on the number of RRsets kept in each of the views,
+	// DefaultMaxEntries is used if the value is not positive.
+	MaxEntries int
+
+	// Upper bound on the estimated memory taken by each of the views,
+	// DefaultMaxBytes is used if the value is not positive.
+	MaxBytes int
+
+	// Number of independently locked parts the cache is split into, the
+	// limits above are divided evenly between them. DefaultShards is used
+	// if the value is not positive.
+	Shards int
+
+	// Time the expired answers are kept for to be served when the name
+	// servers can't be reached (RFC 8767), DefaultStaleWindow is used if
+	// the value is not positive.
+	StaleWindow time.Duration
+
+	// TTL of the stale answers sent to the clients,
+	// DefaultStaleTtl is used if the value is not positive.
+	StaleTtl time.Duration
+
+	// Fraction of the original TTL left at which a queried RRset is
+	// resolved again in the background, DefaultPrefetchRatio is used if the
+	// value is not positive.
+	PrefetchRatio float64
+
+	// Number of hits an RRset needs to be prefetched,
+	// DefaultPrefetchHits is used if the value is not positive.
+	PrefetchHits int
 }
 
+func (c Config) withDefaults() Config {
+	if c.MaxTtl <= 0 {
+		c.MaxTtl = DefaultMaxTtl
+	}
+	if c.MaxNegativeTtl <= 0 {
+		c.MaxNegativeTtl = DefaultMaxNegativeTtl
+	}
+	if c.MaxEntries <= 0 {
+		c.MaxEntries = DefaultMaxEntries
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = DefaultMaxBytes
+	}
+	if c.Shards <= 0 {
+		c.Shards = DefaultShards
+	}
+	if c.StaleWindow <= 0 {
+		c.StaleWindow = DefaultStaleWindow
+	}
+	if c.StaleTtl <= 0 {
+		c.StaleTtl = DefaultStaleTtl
+	}
+	if c.PrefetchRatio <= 0 {
+		c.PrefetchRatio = DefaultPrefetchRatio
+	}
+	if c.PrefetchHits <= 0 {
+		c.PrefetchHits = DefaultPrefetchHits
+	}
+	c.MinTtl = min(c.MinTtl, c.MaxTtl, c.MaxNegativeTtl)
+	return c
+}
+
+// NegativeAnswer is the cached fact that the domain doesn't exist (NXDOMAIN)
+// or doesn't have the records of the given type (NODATA). The SOA record
+// from the authority section is kept to be sent along (RFC 2308).
+type NegativeAnswer struct {
+	ResponseCode types.ResponseCode
+	Soa          types.Record
+}
+
+// Negative answers share the map with the RRsets. NODATA is stored under
+// the key of the missing RRset, NXDOMAIN covers every type of the domain,
+// so it's stored under the key with the reserved type 0.
+const nameErrorType = types.RecordType(0)
+
+type cacheEntry struct {
+	records      []types.Record
+	negative     bool
+	responseCode types.ResponseCode
+	storedAt     time.Time
+	expiresAt    time.Time
+	hits         int
+	prefetching  bool
+}
+
+// recordsAt returns the copy of the records with the TTL set to the time
+// left until the entry expires, so the clients don't keep them for longer
+// than the upstream server intended.
+func (e cacheEntry) recordsAt(now time.Time) []types.Record {
+	return e.recordsWithTtl(uint32(e.expiresAt.Sub(now) / time.Second))
+}
+
+func (e cacheEntry) recordsWithTtl(ttl uint32) []types.Record {
+	records := make([]types.Record, len(e.records))
+	for i, record := range e.records {
+		record.Ttl = ttl
+		records[i] = record
+	}
+	return records
+}
+
+// DnsCache keeps two separate views: the answers received from the name
+// servers and the infrastructure data (delegation NS records and their
+// glue) used to find the name servers to ask, which is less trustworthy
+// and never served to the clients.
+//
+// The cache is split into shards by the owner name, each with its own lock
+// and expiry heap, so the queries for different names rarely contend. All
+// the RRsets of a domain end up in the same shard, which keeps the updates
+// touching several types of the domain (e.g. NXDOMAIN) atomic.
 type DnsCache struct {
-	cache map[dnsCacheKey]cacheRecord
-	mu    sync.RWMutex
+	config     Config
+	shards     []*shard
+	seed       maphash.Seed
+	prefetches chan RRsetKey
+	prefetched atomic.Uint64
+	servers    map[string]ServerInfo
+	serversMu  sync.Mutex
+	now        func() time.Time
+}
+
+type shard struct {
+	mu      sync.Mutex
+	answers *store
+	infra   *store
 }
 
-func NewDnsCache(ctx context.Context) *DnsCache {
-	cache := DnsCache{cache: make(map[dnsCacheKey]cacheRecord)}
+type view int
+
+const (
+	answersView view = iota
+	infraView
+)
+
+func (s *shard) view(v view) *store {
+	if v == infraView {
+		return s.infra
+	}
+	return s.answers
+}
+
+type Stats struct {
+	Entries     int
+	Bytes       int
+	Evictions   uint64
+	Expirations uint64
+	Prefetches  uint64
+}
+
+func NewDnsCache(ctx context.Context, config Config) *DnsCache {
+	return newDnsCache(ctx, config, time.Now)
+}
+
+// newDnsCache takes the clock before the goroutine expiring the entries
+// starts reading it, which lets the tests stop the time.
+func newDnsCache(ctx context.Context, config Config, now func() time.Time) *DnsCache {
+	config = config.withDefaults()
+
+	maxEntries := max(config.MaxEntries/config.Shards, 1)
+	maxBytes := max(config.MaxBytes/config.Shards, 1)
+
+	cache := DnsCache{
+		config:     config,
+		shards:     make([]*shard, config.Shards),
+		seed:       maphash.MakeSeed(),
+		prefetches: make(chan RRsetKey, prefetchQueueSize),
+		servers:    make(map[string]ServerInfo),
+		now:        now,
+	}
+	for i := range cache.shards {
+		cache.shards[i] = &shard{
+			answers: newStore(maxEntries, maxBytes),
+			infra:   newStore(maxEntries, maxBytes),
+		}
+	}
+
 	go cache.watchTtl(ctx)
 	return &cache
 }
 
+func (c *DnsCache) shard(key RRsetKey) *shard {
+	hash := maphash.String(c.seed, key.Domain)
+	return c.shards[hash%uint64(len(c.shards))]
+}
+
+// Stats returns the counters summed over all the shards and both views.
+func (c *DnsCache) Stats() Stats {
+	var stats Stats
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for _, s := range []*store{shard.answers, shard.infra} {
+			stats.Entries += len(s.items)
+			stats.Bytes += s.size
+			stats.Evictions += s.evictions
+			stats.Expirations += s.expirations
+		}
+		shard.mu.Unlock()
+	}
+	stats.Prefetches = c.prefetched.Load()
+	return stats
+}
+
+// Prefetches returns the keys of the popular RRsets that are about to
+// expire. The requests are dropped while nobody reads them, so prefetching
+// is effectively disabled unless the channel is consumed.
+func (c *DnsCache) Prefetches() <-chan RRsetKey {
+	return c.prefetches
+}
+
+// watchTtl removes the expired entries one shard at a time, so the lookups
+// in the other shards are never blocked by the sweep. The answers are only
+// removed once they are too old to be served stale.
 func (c *DnsCache) watchTtl(ctx context.Context) {
 	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case now := <-ticker.C:
-			c.mu.RLock()
-			for domain, packetRecords := range c.cache {
-				if packetRecords.expiresAt.Before(now) {
-					c.mu.RUnlock()
-					c.mu.Lock()
-					delete(c.cache, domain)
-					c.mu.Unlock()
-					c.mu.RLock()
-				}
+		case <-ticker.C:
+			now := c.now()
+			for _, shard := range c.shards {
+				shard.mu.Lock()
+				shard.answers.removeExpired(now.Add(-c.config.StaleWindow))
+				shard.infra.removeExpired(now)
+				shard.mu.Unlock()
 			}
-			c.mu.RUnlock()
+			c.removeExpiredServers(now)
 		}
 	}
 }
 
-func (c *DnsCache) Get(domain string, source net.IP) (types.PacketRecords, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+func (c *DnsCache) Get(key RRsetKey) ([]types.Record, bool) {
+	return c.get(answersView, key, false)
+}
 
-	key := dnsCacheKey{domain, source.String()}
-	packetRecords, ok := c.cache[key]
-	return packetRecords.records, ok
+// GetStale is the same as Get, except the RRsets that have expired less
+// than StaleWindow ago are returned too, with the TTL set to StaleTtl.
+func (c *DnsCache) GetStale(key RRsetKey) ([]types.Record, bool) {
+	return c.get(answersView, key, true)
 }
 
-func (c *DnsCache) Set(domain string, source net.IP, packetRecords types.PacketRecords) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func (c *DnsCache) Set(records []types.Record) {
+	c.set(answersView, records)
+}
 
-	key := dnsCacheKey{domain, source.String()}
-	c.cache[key] = newCacheRecord(packetRecords)
+func (c *DnsCache) GetInfra(key RRsetKey) ([]types.Record, bool) {
+	return c.get(infraView, key, false)
 }
 
-func minTtl(packetRecords types.PacketRecords) uint32 {
-	records := make([]types.Record, 0, packetRecords.Len())
-	records = append(records, packetRecords.Answers...)
-	records = append(records, packetRecords.AuthorityRecords...)
-	records = append(records, packetRecords.AdditionalRecords...)
+func (c *DnsCache) SetInfra(records []types.Record) {
+	c.set(infraView, records)
+}
+
+func (c *DnsCache) GetNegative(key RRsetKey) (NegativeAnswer, bool) {
+	return c.getNegative(key, false)
+}
+
+// GetNegativeStale is the same as GetNegative, except the expired answers
+// are returned as well, the same way GetStale does it.
+func (c *DnsCache) GetNegativeStale(key RRsetKey) (NegativeAnswer, bool) {
+	return c.getNegative(key, true)
+}
+
+func (c *DnsCache) getNegative(key RRsetKey, stale bool) (NegativeAnswer, bool) {
+	shard := c.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := c.now()
+
+	nameErrorKey := RRsetKey{key.Domain, nameErrorType, key.Class}
+	for _, key := range []RRsetKey{nameErrorKey, key} {
+		entry, ok := shard.answers.get(key)
+		if !ok || !entry.negative {
+			continue
+		}
+
+		records, ok := c.usableRecords(*entry, now, stale)
+		if !ok {
+			continue
+		}
+
+		answer := NegativeAnswer{
+			ResponseCode: entry.responseCode,
+			Soa:          records[0],
+		}
+		return answer, true
+	}
+
+	return NegativeAnswer{}, false
+}
+
+// SetNegative stores the negative answer for the RRset, NXDOMAIN is stored
+// for the whole domain regardless of the type in the key. The answer is kept
+// for the smaller of the SOA's TTL and its MINIMUM field (RFC 2308, section 5).
+func (c *DnsCache) SetNegative(key RRsetKey, answer NegativeAnswer) {
+	soa, ok := answer.Soa.Data.(*types.SOARData)
+	if !ok {
+		return
+	}
+
+	ttl := min(answer.Soa.Ttl, soa.Minimum)
+	if ttl == 0 {
+		return
+	}
+
+	if answer.ResponseCode == types.ResponseCodeNameError {
+		key.Type = nameErrorType
+	}
+
+	shard := c.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := c.now()
+	duration := max(c.config.MinTtl, min(time.Duration(ttl)*time.Second, c.config.MaxNegativeTtl))
+
+	shard.answers.set(key, cacheEntry{
+		records:      []types.Record{answer.Soa},
+		negative:     true,
+		responseCode: answer.ResponseCode,
+		storedAt:     now,
+		expiresAt:    now.Add(duration),
+	})
+}
+
+func (c *DnsCache) get(v view, key RRsetKey, stale bool) ([]types.Record, bool) {
+	shard := c.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry, ok := shard.view(v).get(key)
+	if !ok || entry.negative {
+		return nil, false
+	}
+
+	now := c.now()
+
+	records, ok := c.usableRecords(*entry, now, stale)
+	if ok && v == answersView {
+		c.countHit(key, entry, now)
+	}
+	return records, ok
+}
+
+// countHit requests the prefetch of the RRset once it's been hit enough
+// times and has less than PrefetchRatio of its TTL left. Every stored RRset
+// is requested at most once, the new one replacing it starts over.
+func (c *DnsCache) countHit(key RRsetKey, entry *cacheEntry, now time.Time) {
+	entry.hits += 1
+	if entry.prefetching || entry.hits < c.config.PrefetchHits {
+		return
+	}
+
+	left := entry.expiresAt.Sub(now)
+	ttl := entry.expiresAt.Sub(entry.storedAt)
+	if left <= 0 || float64(left) > float64(ttl)*c.config.PrefetchRatio {
+		return
+	}
+
+	select {
+	case c.prefetches <- key:
+		entry.prefetching = true
+		c.prefetched.Add(1)
+	default:
+	}
+}
+
+// usableRecords returns the records of the entry unless it has expired, the
+// expired entries are only used in the stale mode while within StaleWindow.
+func (c *DnsCache) usableRecords(entry cacheEntry, now time.Time, stale bool) ([]types.Record, bool) {
+	if entry.expiresAt.After(now) {
+		return entry.recordsAt(now), true
+	}
+
+	if !stale || !entry.expiresAt.Add(c.config.StaleWindow).After(now) {
+		return nil, false
+	}
+	return entry.recordsWithTtl(uint32(c.config.StaleTtl / time.Second)), true
+}
+
+// set splits the records into RRsets, each of them replaces the one
+// already stored under the same key. RRsets with zero TTL are meant to be
+// used only for the current transaction, so they are never stored.
+func (c *DnsCache) set(v view, records []types.Record) {
+	for key, rrset := range GroupRRsets(records) {
+		ttl := minTtl(rrset)
+		if ttl == 0 {
+			continue
+		}
+
+		c.setRRset(v, key, rrset, ttl)
+	}
+}
+
+func (c *DnsCache) setRRset(v view, key RRsetKey, rrset []types.Record, ttl uint32) {
+	shard := c.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := c.now()
+	entries := shard.view(v)
+
+	entries.set(key, cacheEntry{
+		records:   rrset,
+		storedAt:  now,
+		expiresAt: now.Add(c.clampTtl(ttl)),
+	})
+
+	// The domain evidently exists now.
+	entries.remove(RRsetKey{key.Domain, nameErrorType, key.Class})
+}
+
+func (c *DnsCache) clampTtl(ttl uint32) time.Duration {
+	duration := time.Duration(ttl) * time.Second
+	return max(c.config.MinTtl, min(duration, c.config.MaxTtl))
+}
+
+func GroupRRsets(records []types.Record) map[RRsetKey][]types.Record {
+	rrsets := make(map[RRsetKey][]types.Record)
+	for _, record := range records {
+		key := NewRRsetKey(record.Domain, record.Type, record.Class)
+		rrsets[key] = append(rrsets[key], record)
+	}
+	return rrsets
+}
 
+func minTtl(records []types.Record) uint32 {
 	if len(records) == 0 {
 		return 0
 	}
@@ -0,0 +1,369 @@
+package cache
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+)
+
+func TestCacheRRsets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, _ := newTestCache(ctx, Config{})
+
+	a := types.Record{
+		Domain: "Example.com.",
+		Type:   types.RecordTypeA,
+		Class:  types.RecordClassIN,
+		Ttl:    300,
+		Data:   &types.ARData{IP: net.IPv4(192, 0, 2, 1)},
+	}
+	aaaa := types.Record{
+		Domain: "example.com.",
+		Type:   types.RecordTypeAAAA,
+		Class:  types.RecordClassIN,
+		Ttl:    300,
+		Data:   &types.AAAARData{IP: net.ParseIP("2001:db8::1")},
+	}
+
+	cache.Set([]types.Record{a, aaaa})
+
+	records, ok := cache.Get(NewRRsetKey("EXAMPLE.COM.", types.RecordTypeA, types.RecordClassIN))
+	if !ok || len(records) != 1 || !records[0].Equal(a) {
+		t.Fatalf("expected A record, got %v", records)
+	}
+
+	records, ok = cache.Get(NewRRsetKey("example.com.", types.RecordTypeAAAA, types.RecordClassIN))
+	if !ok || len(records) != 1 || !records[0].Equal(aaaa) {
+		t.Fatalf("expected AAAA record, got %v", records)
+	}
+
+	_, ok = cache.GetInfra(NewRRsetKey("example.com.", types.RecordTypeA, types.RecordClassIN))
+	if ok {
+		t.Fatal("answer is visible in the infrastructure view")
+	}
+}
+
+func TestCacheReplacesRRset(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, _ := newTestCache(ctx, Config{})
+
+	record := func(ip net.IP) types.Record {
+		return types.Record{
+			Domain: "example.com.",
+			Type:   types.RecordTypeA,
+			Class:  types.RecordClassIN,
+			Ttl:    300,
+			Data:   &types.ARData{IP: ip},
+		}
+	}
+
+	cache.Set([]types.Record{record(net.IPv4(192, 0, 2, 1)), record(net.IPv4(192, 0, 2, 2))})
+	cache.Set([]types.Record{record(net.IPv4(192, 0, 2, 3))})
+
+	records, _ := cache.Get(NewRRsetKey("example.com.", types.RecordTypeA, types.RecordClassIN))
+	if len(records) != 1 || !records[0].Equal(record(net.IPv4(192, 0, 2, 3))) {
+		t.Fatalf("expected RRset to be replaced, got %v", records)
+	}
+}
+
+func TestCacheSkipsZeroTtl(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, _ := newTestCache(ctx, Config{})
+	cache.SetInfra([]types.Record{
+		{
+			Domain: "example.com.",
+			Type:   types.RecordTypeNS,
+			Class:  types.RecordClassIN,
+			Ttl:    0,
+			Data:   &types.NSRData{Host: "ns.example.com."},
+		},
+	})
+
+	_, ok := cache.GetInfra(NewRRsetKey("example.com.", types.RecordTypeNS, types.RecordClassIN))
+	if ok {
+		t.Fatal("expired RRset was returned")
+	}
+}
+
+func TestCacheDecrementsTtl(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, clock := newTestCache(ctx, Config{})
+	cache.Set([]types.Record{
+		{Domain: "example.com.", Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 300, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 1)}},
+		{Domain: "example.com.", Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 600, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 2)}},
+	})
+
+	key := NewRRsetKey("example.com.", types.RecordTypeA, types.RecordClassIN)
+
+	clock.Add(299*time.Second + 500*time.Millisecond)
+	records, ok := cache.Get(key)
+	if !ok {
+		t.Fatal("RRset expired too early")
+	}
+
+	for _, record := range records {
+		if record.Ttl != 0 {
+			t.Fatalf("expected TTL 0, got %d", record.Ttl)
+		}
+	}
+
+	clock.Add(time.Second)
+	if _, ok := cache.Get(key); ok {
+		t.Fatal("expired RRset was returned")
+	}
+}
+
+func TestCacheClampsTtl(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, _ := newTestCache(ctx, Config{MinTtl: time.Minute, MaxTtl: time.Hour})
+
+	cache.Set([]types.Record{
+		{Domain: "short.example.", Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 5, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 1)}},
+		{Domain: "long.example.", Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 604800, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 2)}},
+	})
+
+	tests := map[string]uint32{"short.example.": 60, "long.example.": 3600}
+	for domain, expected := range tests {
+		records, ok := cache.Get(NewRRsetKey(domain, types.RecordTypeA, types.RecordClassIN))
+		if !ok || records[0].Ttl != expected {
+			t.Fatalf("%s: expected TTL %d, got %v", domain, expected, records)
+		}
+	}
+}
+
+// testClock stays at the moment it was created until it's moved, it can
+// be read by the goroutine expiring the entries while a test moves it.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newTestCache returns the cache with the clock stopped at the moment of the
+// call, the clock is moved through the returned testClock.
+func newTestCache(ctx context.Context, config Config) (*DnsCache, *testClock) {
+	clock := &testClock{now: time.Now()}
+	return newDnsCache(ctx, config, clock.Now), clock
+}
+
+func TestCacheNegativeAnswers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, clock := newTestCache(ctx, Config{})
+
+	soa := types.Record{
+		Domain: "example.com.",
+		Type:   types.RecordTypeSOA,
+		Class:  types.RecordClassIN,
+		Ttl:    3600,
+		Data:   &types.SOARData{MName: "ns.example.com.", RName: "admin.example.com.", Minimum: 300},
+	}
+
+	cache.SetNegative(
+		NewRRsetKey("missing.example.com.", types.RecordTypeA, types.RecordClassIN),
+		NegativeAnswer{ResponseCode: types.ResponseCodeNameError, Soa: soa},
+	)
+	cache.SetNegative(
+		NewRRsetKey("example.com.", types.RecordTypeAAAA, types.RecordClassIN),
+		NegativeAnswer{ResponseCode: types.ResponseCodeNoError, Soa: soa},
+	)
+
+	clock.Add(100 * time.Second)
+
+	answer, ok := cache.GetNegative(NewRRsetKey("missing.example.com.", types.RecordTypeMX, types.RecordClassIN))
+	if !ok || answer.ResponseCode != types.ResponseCodeNameError {
+		t.Fatal("NXDOMAIN doesn't cover all the types")
+	}
+
+	if answer.Soa.Ttl != 200 {
+		t.Fatalf("expected SOA TTL 200, got %d", answer.Soa.Ttl)
+	}
+
+	answer, ok = cache.GetNegative(NewRRsetKey("example.com.", types.RecordTypeAAAA, types.RecordClassIN))
+	if !ok || answer.ResponseCode != types.ResponseCodeNoError {
+		t.Fatal("NODATA wasn't cached")
+	}
+
+	if _, ok := cache.GetNegative(NewRRsetKey("example.com.", types.RecordTypeA, types.RecordClassIN)); ok {
+		t.Fatal("NODATA covers other types")
+	}
+
+	if _, ok := cache.Get(NewRRsetKey("example.com.", types.RecordTypeAAAA, types.RecordClassIN)); ok {
+		t.Fatal("NODATA was returned as an RRset")
+	}
+
+	cache.Set([]types.Record{
+		{Domain: "missing.example.com.", Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 60, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 1)}},
+	})
+
+	if _, ok := cache.GetNegative(NewRRsetKey("missing.example.com.", types.RecordTypeMX, types.RecordClassIN)); ok {
+		t.Fatal("NXDOMAIN outlived the records of the domain")
+	}
+
+	clock.Add(200 * time.Second)
+
+	if _, ok := cache.GetNegative(NewRRsetKey("example.com.", types.RecordTypeAAAA, types.RecordClassIN)); ok {
+		t.Fatal("NODATA outlived the SOA MINIMUM")
+	}
+}
+
+func TestCacheNegativeWithoutSoa(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, _ := newTestCache(ctx, Config{})
+
+	key := NewRRsetKey("missing.example.com.", types.RecordTypeA, types.RecordClassIN)
+	cache.SetNegative(key, NegativeAnswer{ResponseCode: types.ResponseCodeNameError})
+
+	if _, ok := cache.GetNegative(key); ok {
+		t.Fatal("negative answer without SOA was cached")
+	}
+}
+
+func TestCacheStale(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, clock := newTestCache(ctx, Config{StaleWindow: time.Hour})
+
+	soa := types.Record{
+		Domain: "example.com.",
+		Type:   types.RecordTypeSOA,
+		Class:  types.RecordClassIN,
+		Ttl:    60,
+		Data:   &types.SOARData{MName: "ns.example.com.", RName: "admin.example.com.", Minimum: 60},
+	}
+
+	cache.Set([]types.Record{
+		{Domain: "example.com.", Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 60, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 1)}},
+	})
+	cache.SetNegative(
+		NewRRsetKey("missing.example.com.", types.RecordTypeA, types.RecordClassIN),
+		NegativeAnswer{ResponseCode: types.ResponseCodeNameError, Soa: soa},
+	)
+
+	key := NewRRsetKey("example.com.", types.RecordTypeA, types.RecordClassIN)
+	missingKey := NewRRsetKey("missing.example.com.", types.RecordTypeA, types.RecordClassIN)
+
+	records, ok := cache.GetStale(key)
+	if !ok || records[0].Ttl != 60 {
+		t.Fatalf("expected fresh RRset with TTL 60, got %v", records)
+	}
+
+	clock.Add(30 * time.Minute)
+
+	if _, ok := cache.Get(key); ok {
+		t.Fatal("expired RRset was returned")
+	}
+
+	records, ok = cache.GetStale(key)
+	if !ok || records[0].Ttl != uint32(DefaultStaleTtl/time.Second) {
+		t.Fatalf("expected stale RRset with TTL %v, got %v", DefaultStaleTtl, records)
+	}
+
+	answer, ok := cache.GetNegativeStale(missingKey)
+	if !ok || answer.Soa.Ttl != uint32(DefaultStaleTtl/time.Second) {
+		t.Fatalf("expected stale negative answer, got %v", answer)
+	}
+
+	clock.Add(time.Hour)
+
+	if _, ok := cache.GetStale(key); ok {
+		t.Fatal("RRset was served stale outside of the stale window")
+	}
+	if _, ok := cache.GetNegativeStale(missingKey); ok {
+		t.Fatal("negative answer was served stale outside of the stale window")
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, clock := newTestCache(ctx, Config{PrefetchRatio: 0.1, PrefetchHits: 2})
+	cache.Set([]types.Record{
+		{Domain: "example.com.", Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 100, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 1)}},
+	})
+
+	key := NewRRsetKey("example.com.", types.RecordTypeA, types.RecordClassIN)
+
+	cache.Get(key)
+	clock.Add(95 * time.Second)
+	cache.Get(key)
+	cache.Get(key)
+
+	select {
+	case prefetch := <-cache.Prefetches():
+		if prefetch != key {
+			t.Fatalf("expected prefetch of %v, got %v", key, prefetch)
+		}
+	default:
+		t.Fatal("popular RRset wasn't prefetched")
+	}
+
+	select {
+	case prefetch := <-cache.Prefetches():
+		t.Fatalf("RRset was prefetched twice: %v", prefetch)
+	default:
+	}
+
+	if stats := cache.Stats(); stats.Prefetches != 1 {
+		t.Fatalf("expected 1 prefetch, got %+v", stats)
+	}
+}
+
+func TestCachePrefetchWaitsForExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, clock := newTestCache(ctx, Config{PrefetchRatio: 0.1, PrefetchHits: 2})
+	cache.Set([]types.Record{
+		{Domain: "example.com.", Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 100, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 1)}},
+	})
+
+	key := NewRRsetKey("example.com.", types.RecordTypeA, types.RecordClassIN)
+
+	cache.Get(key)
+	cache.Get(key)
+	clock.Add(50 * time.Second)
+	cache.Get(key)
+
+	select {
+	case prefetch := <-cache.Prefetches():
+		t.Fatalf("RRset with enough TTL left was prefetched: %v", prefetch)
+	default:
+	}
+}
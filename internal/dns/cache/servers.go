@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// Time the knowledge about a name server is kept for since the last
+	// exchange with it, so the servers considered dead are tried again.
+	serverInfoTtl = 15 * time.Minute
+
+	// Upper bound on the smoothed RTT, it's doubled on every failure.
+	maxServerRtt = 5 * time.Second
+
+	// The weight of the new RTT sample is 1/srttWeight (RFC 6298, section 2).
+	srttWeight = 8
+)
+
+// ServerInfo is what is known about the name server from the previous
+// exchanges with it, in the style of the infrastructure cache of Unbound.
+type ServerInfo struct {
+	// Smoothed round-trip time of the exchanges.
+	Srtt time.Duration
+
+	// Number of failures in a row since the last answer.
+	Failures int
+
+	// Whether the server has failed to answer the query with EDNS.
+	NoEdns bool
+
+	updatedAt time.Time
+}
+
+func (c *DnsCache) ServerInfo(ip net.IP) (ServerInfo, bool) {
+	c.serversMu.Lock()
+	defer c.serversMu.Unlock()
+
+	info, ok := c.servers[ip.String()]
+	if !ok || c.now().Sub(info.updatedAt) > serverInfoTtl {
+		return ServerInfo{}, false
+	}
+	return info, true
+}
+
+// ReportRtt records the time the server took to answer.
+func (c *DnsCache) ReportRtt(ip net.IP, rtt time.Duration) {
+	c.updateServer(ip, func(info *ServerInfo, known bool) {
+		if known {
+			info.Srtt += (rtt - info.Srtt) / srttWeight
+		} else {
+			info.Srtt = rtt
+		}
+		info.Failures = 0
+	})
+}
+
+// ReportFailure records that the server has timed out or failed to answer,
+// the penalty grows exponentially with the number of failures in a row.
+func (c *DnsCache) ReportFailure(ip net.IP, timeout time.Duration) {
+	c.updateServer(ip, func(info *ServerInfo, known bool) {
+		info.Srtt = min(max(info.Srtt*2, timeout), maxServerRtt)
+		info.Failures += 1
+	})
+}
+
+func (c *DnsCache) ReportNoEdns(ip net.IP) {
+	c.updateServer(ip, func(info *ServerInfo, known bool) {
+		info.NoEdns = true
+	})
+}
+
+func (c *DnsCache) updateServer(ip net.IP, update func(info *ServerInfo, known bool)) {
+	c.serversMu.Lock()
+	defer c.serversMu.Unlock()
+
+	now := c.now()
+
+	key := ip.String()
+	info, known := c.servers[key]
+	if known && now.Sub(info.updatedAt) > serverInfoTtl {
+		info, known = ServerInfo{}, false
+	}
+
+	update(&info, known)
+	info.updatedAt = now
+	c.servers[key] = info
+}
+
+func (c *DnsCache) removeExpiredServers(now time.Time) {
+	c.serversMu.Lock()
+	defer c.serversMu.Unlock()
+
+	for key, info := range c.servers {
+		if now.Sub(info.updatedAt) > serverInfoTtl {
+			delete(c.servers, key)
+		}
+	}
+}
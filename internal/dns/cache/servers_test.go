@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerInfoSrtt(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, _ := newTestCache(ctx, Config{})
+	ip := net.IPv4(192, 0, 2, 53)
+
+	if _, ok := cache.ServerInfo(ip); ok {
+		t.Fatal("unknown server has info")
+	}
+
+	cache.ReportRtt(ip, 80*time.Millisecond)
+	cache.ReportRtt(ip, 160*time.Millisecond)
+
+	info, ok := cache.ServerInfo(ip)
+	if !ok || info.Srtt != 90*time.Millisecond {
+		t.Fatalf("expected SRTT 90ms, got %v", info.Srtt)
+	}
+}
+
+func TestServerInfoFailures(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, clock := newTestCache(ctx, Config{})
+	ip := net.IPv4(192, 0, 2, 53)
+
+	cache.ReportRtt(ip, 100*time.Millisecond)
+	cache.ReportFailure(ip, 2*time.Second)
+	cache.ReportFailure(ip, 2*time.Second)
+	cache.ReportNoEdns(ip)
+
+	info, _ := cache.ServerInfo(ip)
+	if info.Srtt != 4*time.Second || info.Failures != 2 || !info.NoEdns {
+		t.Fatalf("unexpected info after failures: %+v", info)
+	}
+
+	cache.ReportFailure(ip, 2*time.Second)
+	if info, _ := cache.ServerInfo(ip); info.Srtt != maxServerRtt {
+		t.Fatalf("expected SRTT capped at %v, got %v", maxServerRtt, info.Srtt)
+	}
+
+	cache.ReportRtt(ip, 100*time.Millisecond)
+	if info, _ := cache.ServerInfo(ip); info.Failures != 0 {
+		t.Fatalf("failures weren't reset: %+v", info)
+	}
+
+	clock.Add(serverInfoTtl + time.Second)
+	if _, ok := cache.ServerInfo(ip); ok {
+		t.Fatal("stale server info was returned")
+	}
+}
@@ -0,0 +1,299 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/serde"
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+	"github.com/SergeyCherepiuk/dns-go/internal/utils"
+)
+
+// Snapshot file format, all the integers are big-endian:
+//
+//	magic    4 bytes, "DNSC"
+//	version  uint16, SnapshotVersion
+//	taken    int64, Unix time (nanoseconds) the snapshot was taken at
+//	entries  repeated until the end of the file
+//
+// Every entry is:
+//
+//	view     uint8, 0 for the answers and 1 for the infrastructure data
+//	negative uint8, 1 if the entry is a negative answer, 0 otherwise
+//	age      uint32, seconds passed since the entry was stored
+//	ttl      uint32, seconds left until the entry expires
+//	class    uint16 and type uint16 of the key (type 0 for NXDOMAIN)
+//	domain   uint8 length followed by the lowercased owner name of the key
+//	message  uint16 length followed by the DNS message (RFC 1035) with the
+//	         response code of the negative answer in the header and the
+//	         records in the answer section
+//
+// On load the time passed since the snapshot was taken is subtracted from
+// the TTLs, the entries that have expired meanwhile are skipped.
+const (
+	SnapshotVersion = 1
+	snapshotMagic   = "DNSC"
+)
+
+var (
+	ErrInvalidSnapshot            = errors.New("invalid cache snapshot")
+	ErrUnsupportedSnapshotVersion = errors.New("unsupported cache snapshot version")
+	ErrUntrustedSnapshot          = errors.New("cache snapshot can be written by other users")
+)
+
+type snapshotHeader struct {
+	Magic   [4]byte
+	Version uint16
+	Taken   int64
+}
+
+type snapshotEntryHeader struct {
+	View     uint8
+	Negative uint8
+	Age      uint32
+	Ttl      uint32
+	Class    uint16
+	Type     uint16
+}
+
+// SaveSnapshot writes the snapshot to a temporary file first and renames it
+// afterwards, so the previous snapshot is kept intact if the write fails.
+func (c *DnsCache) SaveSnapshot(path string) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	err = c.WriteSnapshot(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// LoadSnapshot reads the snapshot from the file, which has to be owned by
+// the current user and not writable by anyone else, since the records from
+// it are served to the clients as they are.
+func (c *DnsCache) LoadSnapshot(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = checkSnapshotFile(info)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, path)
+	}
+
+	return c.ReadSnapshot(file)
+}
+
+func (c *DnsCache) WriteSnapshot(w io.Writer) error {
+	now := c.now()
+	bw := bufio.NewWriter(w)
+
+	header := snapshotHeader{Version: SnapshotVersion, Taken: now.UnixNano()}
+	copy(header.Magic[:], snapshotMagic)
+
+	err := binary.Write(bw, binary.BigEndian, header)
+	if err != nil {
+		return err
+	}
+
+	for _, shard := range c.shards {
+		for _, v := range []view{answersView, infraView} {
+			shard.mu.Lock()
+			items := make([]storeItem, 0, len(shard.view(v).items))
+			for _, item := range shard.view(v).items {
+				items = append(items, *item)
+			}
+			shard.mu.Unlock()
+
+			for _, item := range items {
+				if !item.entry.expiresAt.After(now) {
+					continue
+				}
+
+				err := writeSnapshotEntry(bw, v, item.key, item.entry, now)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+func writeSnapshotEntry(w io.Writer, v view, key RRsetKey, entry cacheEntry, now time.Time) error {
+	if len(key.Domain) > 255 {
+		return fmt.Errorf("%w: domain %q is too long", ErrInvalidSnapshot, key.Domain)
+	}
+
+	message := types.Packet{
+		Header: types.Header{PacketType: types.PacketTypeResponse, ResponseCode: entry.responseCode},
+		Records: types.PacketRecords{
+			Answers: entry.records,
+		},
+	}
+	message.UpdateSectionSizes()
+
+	messageBytes, err := serde.MarshalPacket(message, types.MaxTcpPacketSize)
+	if err != nil {
+		return err
+	}
+
+	header := snapshotEntryHeader{
+		View:     uint8(v),
+		Negative: utils.BoolToUint8(entry.negative),
+		Age:      uint32(now.Sub(entry.storedAt) / time.Second),
+		Ttl:      uint32(entry.expiresAt.Sub(now) / time.Second),
+		Class:    uint16(key.Class),
+		Type:     uint16(key.Type),
+	}
+
+	err = binary.Write(w, binary.BigEndian, header)
+	if err != nil {
+		return err
+	}
+
+	err = writeWithLength(w, []byte(key.Domain), 1)
+	if err != nil {
+		return err
+	}
+
+	return writeWithLength(w, messageBytes, 2)
+}
+
+// ReadSnapshot adds the entries from the snapshot to the cache, replacing
+// the ones already stored under the same keys.
+func (c *DnsCache) ReadSnapshot(r io.Reader) error {
+	now := c.now()
+	br := bufio.NewReader(r)
+
+	var header snapshotHeader
+	err := binary.Read(br, binary.BigEndian, &header)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+
+	if string(header.Magic[:]) != snapshotMagic {
+		return ErrInvalidSnapshot
+	}
+
+	if header.Version != SnapshotVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedSnapshotVersion, header.Version)
+	}
+
+	offline := max(now.Sub(time.Unix(0, header.Taken)), 0)
+
+	for {
+		var entryHeader snapshotEntryHeader
+		err := binary.Read(br, binary.BigEndian, &entryHeader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+		}
+
+		domain, err := readWithLength(br, 1)
+		if err != nil {
+			return err
+		}
+
+		messageBytes, err := readWithLength(br, 2)
+		if err != nil {
+			return err
+		}
+
+		if entryHeader.View > uint8(infraView) {
+			return fmt.Errorf("%w: unknown view %d", ErrInvalidSnapshot, entryHeader.View)
+		}
+
+		message, err := serde.UnmarshalPacket(messageBytes)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+		}
+
+		ttl := time.Duration(entryHeader.Ttl)*time.Second - offline
+		if ttl <= 0 || len(message.Records.Answers) == 0 {
+			continue
+		}
+
+		key := NewRRsetKey(string(domain), types.RecordType(entryHeader.Type), types.RecordClass(entryHeader.Class))
+		entry := cacheEntry{
+			records:      message.Records.Answers,
+			negative:     entryHeader.Negative == 1,
+			responseCode: message.Header.ResponseCode,
+			storedAt:     now.Add(-offline - time.Duration(entryHeader.Age)*time.Second),
+			expiresAt:    now.Add(ttl),
+		}
+
+		shard := c.shard(key)
+		shard.mu.Lock()
+		shard.view(view(entryHeader.View)).set(key, entry)
+		shard.mu.Unlock()
+	}
+}
+
+func writeWithLength(w io.Writer, bytes []byte, lengthSize int) error {
+	var err error
+	if lengthSize == 1 {
+		err = binary.Write(w, binary.BigEndian, uint8(len(bytes)))
+	} else {
+		err = binary.Write(w, binary.BigEndian, uint16(len(bytes)))
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(bytes)
+	return err
+}
+
+func readWithLength(r io.Reader, lengthSize int) ([]byte, error) {
+	var length int
+	if lengthSize == 1 {
+		var u8 uint8
+		err := binary.Read(r, binary.BigEndian, &u8)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+		}
+		length = int(u8)
+	} else {
+		var u16 uint16
+		err := binary.Read(r, binary.BigEndian, &u16)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+		}
+		length = int(u16)
+	}
+
+	bytes := make([]byte, length)
+	_, err := io.ReadFull(r, bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+	return bytes, nil
+}
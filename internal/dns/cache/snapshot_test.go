@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, clock := newTestCache(ctx, Config{})
+
+	a := types.Record{Domain: "example.com.", Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 300, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 1)}}
+	short := types.Record{Domain: "short.example.com.", Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 30, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 2)}}
+	ns := types.Record{Domain: "example.com.", Type: types.RecordTypeNS, Class: types.RecordClassIN, Ttl: 3600, Data: &types.NSRData{Host: "ns.example.com."}}
+	soa := types.Record{
+		Domain: "example.com.",
+		Type:   types.RecordTypeSOA,
+		Class:  types.RecordClassIN,
+		Ttl:    3600,
+		Data:   &types.SOARData{MName: "ns.example.com.", RName: "admin.example.com.", Minimum: 300},
+	}
+
+	cache.Set([]types.Record{a, short})
+	cache.SetInfra([]types.Record{ns})
+	cache.SetNegative(
+		NewRRsetKey("missing.example.com.", types.RecordTypeA, types.RecordClassIN),
+		NegativeAnswer{ResponseCode: types.ResponseCodeNameError, Soa: soa},
+	)
+
+	var snapshot bytes.Buffer
+	err := cache.WriteSnapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, restoredClock := newTestCache(ctx, Config{})
+	restoredClock.Set(clock.Now().Add(100 * time.Second))
+
+	err = restored.ReadSnapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, ok := restored.Get(NewRRsetKey("example.com.", types.RecordTypeA, types.RecordClassIN))
+	if !ok || len(records) != 1 || records[0].Ttl != 200 {
+		t.Fatalf("expected A record with TTL 200, got %v", records)
+	}
+
+	if _, ok := restored.Get(NewRRsetKey("short.example.com.", types.RecordTypeA, types.RecordClassIN)); ok {
+		t.Fatal("RRset expired while offline was restored")
+	}
+
+	if _, ok := restored.GetInfra(NewRRsetKey("example.com.", types.RecordTypeNS, types.RecordClassIN)); !ok {
+		t.Fatal("delegation wasn't restored")
+	}
+
+	answer, ok := restored.GetNegative(NewRRsetKey("missing.example.com.", types.RecordTypeMX, types.RecordClassIN))
+	if !ok || answer.ResponseCode != types.ResponseCodeNameError || answer.Soa.Ttl != 200 {
+		t.Fatalf("expected NXDOMAIN with SOA TTL 200, got %v", answer)
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	cache, _ := newTestCache(ctx, Config{})
+	cache.Set([]types.Record{
+		{Domain: "example.com.", Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 300, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 1)}},
+	})
+
+	err := cache.SaveSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, _ := newTestCache(ctx, Config{})
+	err = restored.LoadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := restored.Get(NewRRsetKey("example.com.", types.RecordTypeA, types.RecordClassIN)); !ok {
+		t.Fatal("RRset wasn't restored")
+	}
+}
+
+func TestSnapshotInvalid(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, _ := newTestCache(ctx, Config{})
+
+	tests := map[string]struct {
+		snapshot []byte
+		err      error
+	}{
+		"empty":           {[]byte{}, ErrInvalidSnapshot},
+		"wrong magic":     {[]byte("DNSX\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00"), ErrInvalidSnapshot},
+		"unknown version": {[]byte("DNSC\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00"), ErrUnsupportedSnapshotVersion},
+		"truncated entry": {[]byte("DNSC\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), ErrInvalidSnapshot},
+	}
+
+	for name, test := range tests {
+		err := cache.ReadSnapshot(bytes.NewReader(test.snapshot))
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", name, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package cache
+
+import (
+	"os"
+	"syscall"
+)
+
+// checkSnapshotFile makes sure that nobody but the current user could have
+// written the snapshot file.
+func checkSnapshotFile(info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || int(stat.Uid) != os.Getuid() {
+		return ErrUntrustedSnapshot
+	}
+
+	if info.Mode().Perm()&0o022 != 0 {
+		return ErrUntrustedSnapshot
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+//go:build unix
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSnapshotUntrusted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	cache, _ := newTestCache(ctx, Config{})
+	err := cache.SaveSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chmod(path, 0o666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cache.LoadSnapshot(path)
+	if !errors.Is(err, ErrUntrustedSnapshot) {
+		t.Fatalf("expected %v for world-writable file, got %v", ErrUntrustedSnapshot, err)
+	}
+
+	if os.Getuid() != 0 {
+		return
+	}
+
+	err = os.Chmod(path, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chown(path, 65534, 65534)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cache.LoadSnapshot(path)
+	if !errors.Is(err, ErrUntrustedSnapshot) {
+		t.Fatalf("expected %v for file of another user, got %v", ErrUntrustedSnapshot, err)
+	}
+}
@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"time"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+)
+
+// Rough estimate of the memory taken by the bookkeeping of a single entry
+// (map bucket, list element, heap slot and the slices' headers).
+const entryOverhead = 128
+
+type storeItem struct {
+	key       RRsetKey
+	entry     cacheEntry
+	size      int
+	element   *list.Element
+	heapIndex int
+}
+
+// store is a bounded map of the cache entries. Once either of the limits is
+// exceeded the least recently used entries are evicted, the expired ones
+// are found through the heap ordered by the expiration time.
+type store struct {
+	items      map[RRsetKey]*storeItem
+	recency    *list.List
+	expiry     expiryHeap
+	size       int
+	maxEntries int
+	maxBytes   int
+
+	evictions   uint64
+	expirations uint64
+}
+
+func newStore(maxEntries, maxBytes int) *store {
+	return &store{
+		items:      make(map[RRsetKey]*storeItem),
+		recency:    list.New(),
+		expiry:     make(expiryHeap, 0),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+	}
+}
+
+// get returns the pointer to the stored entry, which stays valid only while
+// the lock of the shard is held.
+func (s *store) get(key RRsetKey) (*cacheEntry, bool) {
+	item, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	s.recency.MoveToFront(item.element)
+	return &item.entry, true
+}
+
+func (s *store) set(key RRsetKey, entry cacheEntry) {
+	size := entrySize(key, entry)
+
+	item, ok := s.items[key]
+	if ok {
+		s.size += size - item.size
+		item.entry = entry
+		item.size = size
+		s.recency.MoveToFront(item.element)
+		heap.Fix(&s.expiry, item.heapIndex)
+	} else {
+		item = &storeItem{key: key, entry: entry, size: size}
+		item.element = s.recency.PushFront(item)
+		heap.Push(&s.expiry, item)
+		s.items[key] = item
+		s.size += size
+	}
+
+	for len(s.items) > s.maxEntries || s.size > s.maxBytes {
+		oldest := s.recency.Back()
+		if oldest == nil || oldest == item.element {
+			break
+		}
+
+		s.removeItem(oldest.Value.(*storeItem))
+		s.evictions += 1
+	}
+}
+
+func (s *store) remove(key RRsetKey) {
+	item, ok := s.items[key]
+	if ok {
+		s.removeItem(item)
+	}
+}
+
+func (s *store) removeExpired(now time.Time) {
+	for len(s.expiry) > 0 && !s.expiry[0].entry.expiresAt.After(now) {
+		s.removeItem(s.expiry[0])
+		s.expirations += 1
+	}
+}
+
+func (s *store) removeItem(item *storeItem) {
+	delete(s.items, item.key)
+	s.recency.Remove(item.element)
+	heap.Remove(&s.expiry, item.heapIndex)
+	s.size -= item.size
+}
+
+func entrySize(key RRsetKey, entry cacheEntry) int {
+	size := entryOverhead + len(key.Domain)
+	for _, record := range entry.records {
+		size += types.DomainLen(record.Domain) + 10
+		if record.Data != nil {
+			size += record.Data.Len()
+		}
+	}
+	return size
+}
+
+type expiryHeap []*storeItem
+
+func (h expiryHeap) Len() int {
+	return len(h)
+}
+
+func (h expiryHeap) Less(i, j int) bool {
+	return h[i].entry.expiresAt.Before(h[j].entry.expiresAt)
+}
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	item := x.(*storeItem)
+	item.heapIndex = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+)
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, _ := newTestCache(ctx, Config{MaxEntries: 2, Shards: 1})
+
+	record := func(domain string) types.Record {
+		return types.Record{
+			Domain: domain,
+			Type:   types.RecordTypeA,
+			Class:  types.RecordClassIN,
+			Ttl:    300,
+			Data:   &types.ARData{IP: net.IPv4(192, 0, 2, 1)},
+		}
+	}
+	key := func(domain string) RRsetKey {
+		return NewRRsetKey(domain, types.RecordTypeA, types.RecordClassIN)
+	}
+
+	cache.Set([]types.Record{record("a.example.")})
+	cache.Set([]types.Record{record("b.example.")})
+	cache.Get(key("a.example."))
+	cache.Set([]types.Record{record("c.example.")})
+
+	if _, ok := cache.Get(key("b.example.")); ok {
+		t.Fatal("least recently used RRset wasn't evicted")
+	}
+	for _, domain := range []string{"a.example.", "c.example."} {
+		if _, ok := cache.Get(key(domain)); !ok {
+			t.Fatalf("%s: RRset was evicted", domain)
+		}
+	}
+
+	stats := cache.Stats()
+	if stats.Entries != 2 || stats.Evictions != 1 {
+		t.Fatalf("expected 2 entries and 1 eviction, got %+v", stats)
+	}
+}
+
+func TestCacheByteBudget(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, _ := newTestCache(ctx, Config{MaxBytes: 4 * entryOverhead, Shards: 1})
+
+	for i := range 10 {
+		cache.Set([]types.Record{{
+			Domain: fmt.Sprintf("host%d.example.", i),
+			Type:   types.RecordTypeA,
+			Class:  types.RecordClassIN,
+			Ttl:    300,
+			Data:   &types.ARData{IP: net.IPv4(192, 0, 2, byte(i))},
+		}})
+	}
+
+	stats := cache.Stats()
+	if stats.Bytes > 4*entryOverhead {
+		t.Fatalf("byte budget exceeded: %+v", stats)
+	}
+	if stats.Entries == 0 || stats.Entries+int(stats.Evictions) != 10 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestStoreRemovesExpired(t *testing.T) {
+	s := newStore(DefaultMaxEntries, DefaultMaxBytes)
+	now := time.Now()
+
+	for i, ttl := range []time.Duration{3, 1, 2} {
+		key := NewRRsetKey(fmt.Sprintf("host%d.example.", i), types.RecordTypeA, types.RecordClassIN)
+		s.set(key, cacheEntry{storedAt: now, expiresAt: now.Add(ttl * time.Second)})
+	}
+
+	s.removeExpired(now.Add(2 * time.Second))
+	if len(s.items) != 1 || s.expirations != 2 {
+		t.Fatalf("expected 1 entry and 2 expirations, got %d and %d", len(s.items), s.expirations)
+	}
+
+	if _, ok := s.get(NewRRsetKey("host0.example.", types.RecordTypeA, types.RecordClassIN)); !ok {
+		t.Fatal("entry expired too early")
+	}
+
+	s.removeExpired(now.Add(3 * time.Second))
+	if len(s.items) != 0 || len(s.expiry) != 0 || s.recency.Len() != 0 || s.size != 0 {
+		t.Fatal("store isn't empty")
+	}
+}
@@ -0,0 +1,294 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/cache"
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+)
+
+func TestCacheResponse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := cache.NewDnsCache(ctx, cache.Config{})
+
+	query := constructQuery("www.example.com.", types.QuestionTypeA)
+	question := query.Questions[0]
+	response := types.Packet{
+		Records: types.PacketRecords{
+			Answers: []types.Record{
+				{Domain: "www.example.com.", Type: types.RecordTypeCNAME, Class: types.RecordClassIN, Ttl: 60, Data: &types.CNAMERData{Target: "web.example.com."}},
+				{Domain: "web.example.com.", Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 60, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 1)}},
+				{Domain: "bank.example.", Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 60, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 66)}},
+			},
+		},
+	}
+
+	cacheResponse(c, question, response)
+
+	cached, domain, complete := cachedResponse(c, query)
+	if !complete || domain != "web.example.com." || len(cached.Records.Answers) != 2 {
+		t.Fatalf("expected complete chain to web.example.com., got %v", cached.Records.Answers)
+	}
+
+	if cached.Header.ID != query.Header.ID || cached.Header.PacketType != types.PacketTypeResponse {
+		t.Fatalf("expected response to the query, got %v", cached.Header)
+	}
+
+	_, ok := c.Get(cache.NewRRsetKey("bank.example.", types.RecordTypeA, types.RecordClassIN))
+	if ok {
+		t.Fatal("record unrelated to the question was cached")
+	}
+
+	aaaaQuery := constructQuery("www.example.com.", types.QuestionTypeAAAA)
+
+	cached, domain, complete = cachedResponse(c, aaaaQuery)
+	if complete || domain != "web.example.com." || len(cached.Records.Answers) != 1 {
+		t.Fatalf("expected CNAME only, got %v", cached.Records.Answers)
+	}
+}
+
+func TestCacheDelegation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := cache.NewDnsCache(ctx, cache.Config{})
+
+	question := types.Question{Domain: "www.example.com.", Type: types.QuestionTypeA, Class: types.QuestionClassIN}
+	referral := types.Packet{
+		Records: types.PacketRecords{
+			AuthorityRecords: []types.Record{
+				{Domain: "example.com.", Type: types.RecordTypeNS, Class: types.RecordClassIN, Ttl: 60, Data: &types.NSRData{Host: "ns1.example.com."}},
+				{Domain: "example.com.", Type: types.RecordTypeNS, Class: types.RecordClassIN, Ttl: 60, Data: &types.NSRData{Host: "ns.example.net."}},
+				{Domain: "other.org.", Type: types.RecordTypeNS, Class: types.RecordClassIN, Ttl: 60, Data: &types.NSRData{Host: "ns.evil.org."}},
+			},
+			AdditionalRecords: []types.Record{
+				{Domain: "ns1.example.com.", Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 60, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 53)}},
+				{Domain: "www.example.com.", Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 60, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 66)}},
+			},
+		},
+	}
+
+	cacheResponse(c, question, referral)
+
+	servers, zone := closestNameServers(c, "mail.example.com.")
+	if zone != "example.com." {
+		t.Fatalf("expected example.com. zone, got %q", zone)
+	}
+
+	if len(servers.addrs) != 1 || !servers.addrs[0].Equal(net.IPv4(192, 0, 2, 53)) {
+		t.Fatalf("expected glue address, got %v", servers.addrs)
+	}
+
+	if len(servers.hosts) != 1 || servers.hosts[0] != "ns.example.net." {
+		t.Fatalf("expected host without glue, got %v", servers.hosts)
+	}
+
+	_, ok := c.GetInfra(cache.NewRRsetKey("other.org.", types.RecordTypeNS, types.RecordClassIN))
+	if ok {
+		t.Fatal("out of bailiwick delegation was cached")
+	}
+
+	_, ok = c.GetInfra(cache.NewRRsetKey("www.example.com.", types.RecordTypeA, types.RecordClassIN))
+	if ok {
+		t.Fatal("additional record other than glue was cached")
+	}
+
+	servers, zone = closestNameServers(c, "example.org.")
+	if zone != "" || len(servers.addrs) != len(RootServers)+len(RootServersV6) {
+		t.Fatalf("expected root servers, got %v", servers.addrs)
+	}
+}
+
+func TestSanitizeResponse(t *testing.T) {
+	question := types.Question{Domain: "www.evil.com.", Type: types.QuestionTypeA, Class: types.QuestionClassIN}
+
+	ns := func(zone, host string) types.Record {
+		return types.Record{Domain: zone, Type: types.RecordTypeNS, Class: types.RecordClassIN, Ttl: 60, Data: &types.NSRData{Host: host}}
+	}
+	a := func(domain string) types.Record {
+		return types.Record{Domain: domain, Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 60, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 66)}}
+	}
+	cname := types.Record{Domain: "www.evil.com.", Type: types.RecordTypeCNAME, Class: types.RecordClassIN, Ttl: 60, Data: &types.CNAMERData{Target: "www.bank.com."}}
+
+	tests := []struct {
+		name                 string
+		zone                 string
+		response             types.Packet
+		expectedResponseCode types.ResponseCode
+		expectedAnswers      int
+		expectedAuthority    int
+		expectedAdditional   int
+	}{
+		{
+			name: "cname out of the zone",
+			zone: "evil.com.",
+			response: types.Packet{
+				Records: types.PacketRecords{Answers: []types.Record{cname, a("www.bank.com.")}},
+			},
+			expectedAnswers: 1,
+		},
+		{
+			name: "nxdomain for the target out of the zone",
+			zone: "evil.com.",
+			response: types.Packet{
+				Header: types.Header{ResponseCode: types.ResponseCodeNameError},
+				Records: types.PacketRecords{
+					Answers:          []types.Record{cname},
+					AuthorityRecords: []types.Record{{Domain: "bank.com.", Type: types.RecordTypeSOA, Class: types.RecordClassIN, Data: &types.SOARData{}}},
+				},
+			},
+			expectedResponseCode: types.ResponseCodeNoError,
+			expectedAnswers:      1,
+		},
+		{
+			name: "referral up the tree",
+			zone: "evil.com.",
+			response: types.Packet{
+				Records: types.PacketRecords{
+					AuthorityRecords:  []types.Record{ns("com.", "ns.evil.com.")},
+					AdditionalRecords: []types.Record{a("ns.evil.com.")},
+				},
+			},
+		},
+		{
+			name: "referral to the zone itself",
+			zone: "evil.com.",
+			response: types.Packet{
+				Records: types.PacketRecords{AuthorityRecords: []types.Record{ns("evil.com.", "ns.evil.com.")}},
+			},
+		},
+		{
+			name: "glue out of the zone",
+			zone: "com.",
+			response: types.Packet{
+				Records: types.PacketRecords{
+					AuthorityRecords:  []types.Record{ns("evil.com.", "ns.evil.com."), ns("evil.com.", "ns.evil.net.")},
+					AdditionalRecords: []types.Record{a("ns.evil.com."), a("ns.evil.net.")},
+				},
+			},
+			expectedAuthority:  2,
+			expectedAdditional: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sanitized := sanitizeResponse(question, test.zone, test.response)
+
+			if sanitized.Header.ResponseCode != test.expectedResponseCode {
+				t.Fatalf("expected response code %d, got %d", test.expectedResponseCode, sanitized.Header.ResponseCode)
+			}
+
+			records := sanitized.Records
+			if len(records.Answers) != test.expectedAnswers ||
+				len(records.AuthorityRecords) != test.expectedAuthority ||
+				len(records.AdditionalRecords) != test.expectedAdditional {
+				t.Fatalf("unexpected records left: %v", records)
+			}
+		})
+	}
+}
+
+func TestCachedAddressesPrefersAnswers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := cache.NewDnsCache(ctx, cache.Config{})
+	c.SetInfra([]types.Record{
+		{Domain: "ns.example.com.", Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 60, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 1)}},
+	})
+	c.Set([]types.Record{
+		{Domain: "ns.example.com.", Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 60, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 2)}},
+	})
+
+	addrs := cachedAddresses(c, "ns.example.com.")
+	if len(addrs) != 1 || !addrs[0].Equal(net.IPv4(192, 0, 2, 2)) {
+		t.Fatalf("expected the address from the answer, got %v", addrs)
+	}
+}
+
+func TestClosestNameServersSkipsGluelessZone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := cache.NewDnsCache(ctx, cache.Config{})
+	c.SetInfra([]types.Record{
+		{Domain: "example.", Type: types.RecordTypeNS, Class: types.RecordClassIN, Ttl: 60, Data: &types.NSRData{Host: "ns.example.net."}},
+	})
+	c.SetInfra([]types.Record{
+		{Domain: "evil.example.", Type: types.RecordTypeNS, Class: types.RecordClassIN, Ttl: 60, Data: &types.NSRData{Host: "ns.evil.example."}},
+	})
+
+	servers, _ := closestNameServers(c, "ns.evil.example.")
+	if len(servers.addrs) != 0 || len(servers.hosts) != 1 || servers.hosts[0] != "ns.example.net." {
+		t.Fatalf("expected the servers of the parent zone, got %v", servers)
+	}
+}
+
+func TestIsSubdomain(t *testing.T) {
+	tests := []struct {
+		domain, zone string
+		expected     bool
+	}{
+		{"www.example.com.", "example.com.", true},
+		{"example.com.", "EXAMPLE.com.", true},
+		{"example.com.", "", true},
+		{"badexample.com.", "example.com.", false},
+		{"example.com.", "www.example.com.", false},
+	}
+
+	for _, test := range tests {
+		if actual := isSubdomain(test.domain, test.zone); actual != test.expected {
+			t.Errorf("isSubdomain(%q, %q): expected %t, got %t", test.domain, test.zone, test.expected, actual)
+		}
+	}
+}
+
+func TestCacheNegativeResponse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := cache.NewDnsCache(ctx, cache.Config{})
+
+	soa := types.Record{
+		Domain: "example.net.",
+		Type:   types.RecordTypeSOA,
+		Class:  types.RecordClassIN,
+		Ttl:    300,
+		Data:   &types.SOARData{MName: "ns.example.net.", RName: "admin.example.net.", Minimum: 300},
+	}
+
+	query := constructQuery("www.example.com.", types.QuestionTypeA)
+	response := types.Packet{
+		Header: types.Header{ResponseCode: types.ResponseCodeNameError},
+		Records: types.PacketRecords{
+			Answers: []types.Record{
+				{Domain: "www.example.com.", Type: types.RecordTypeCNAME, Class: types.RecordClassIN, Ttl: 300, Data: &types.CNAMERData{Target: "missing.example.net."}},
+			},
+			AuthorityRecords: []types.Record{soa},
+		},
+	}
+
+	cacheResponse(c, query.Questions[0], response)
+
+	cached, domain, complete := cachedResponse(c, query)
+	if !complete || domain != "missing.example.net." {
+		t.Fatalf("expected complete response for missing.example.net., got %s", domain)
+	}
+
+	if cached.Header.ResponseCode != types.ResponseCodeNameError {
+		t.Fatalf("expected NXDOMAIN, got %d", cached.Header.ResponseCode)
+	}
+
+	if len(cached.Records.Answers) != 1 || len(cached.Records.AuthorityRecords) != 1 {
+		t.Fatalf("expected CNAME and SOA, got %v", cached.Records)
+	}
+
+	if cached.Records.AuthorityRecords[0].Type != types.RecordTypeSOA {
+		t.Fatalf("expected SOA, got %v", cached.Records.AuthorityRecords[0])
+	}
+}
@@ -1,11 +1,14 @@
 package dns
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
 	"math/rand"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/SergeyCherepiuk/dns-go/internal/dns/cache"
 	"github.com/SergeyCherepiuk/dns-go/internal/dns/serde"
@@ -28,156 +31,601 @@ var RootServers = [13]net.IP{
 	net.IPv4(202, 12, 27, 33),   // m.root-servers.net.
 }
 
+var RootServersV6 = [13]net.IP{
+	net.ParseIP("2001:503:ba3e::2:30"), // a.root-servers.net.
+	net.ParseIP("2801:1b8:10::b"),      // b.root-servers.net.
+	net.ParseIP("2001:500:2::c"),       // c.root-servers.net.
+	net.ParseIP("2001:500:2d::d"),      // d.root-servers.net.
+	net.ParseIP("2001:500:a8::e"),      // e.root-servers.net.
+	net.ParseIP("2001:500:2f::f"),      // f.root-servers.net.
+	net.ParseIP("2001:500:12::d0d"),    // g.root-servers.net.
+	net.ParseIP("2001:500:1::53"),      // h.root-servers.net.
+	net.ParseIP("2001:7fe::53"),        // i.root-servers.net.
+	net.ParseIP("2001:503:c27::2:30"),  // j.root-servers.net.
+	net.ParseIP("2001:7fd::1"),         // k.root-servers.net.
+	net.ParseIP("2001:500:9f::42"),     // l.root-servers.net.
+	net.ParseIP("2001:dc3::35"),        // m.root-servers.net.
+}
+
+const (
+	UpstreamTimeout     = 2 * time.Second
+	maxCnameChainLength = 16
+
+	// Limits on the lookups of the name server addresses done on behalf of
+	// a single query: how deep they may nest and how many there may be.
+	maxLookupDepth = 8
+	maxLookups     = 64
+)
+
+// Port the name servers are queried on, only the tests point it elsewhere.
+var nameServerPort = 53
+
 var (
 	ErrUnableToResolve   = errors.New("unable to resolve")
 	ErrInvalidRecordType = errors.New("invalid record type")
+	ErrNameServerFailure = errors.New("name server failed to answer")
+	ErrCnameChainTooLong = errors.New("cname chain too long")
+	ErrNameServerLoop    = errors.New("name server depends on itself")
+	ErrLookupTooDeep     = errors.New("too many nested lookups")
+	ErrTooManyLookups    = errors.New("too many lookups")
 )
 
-func Lookup(query types.Packet, cache *cache.DnsCache) (types.Packet, error) {
-	var (
-		initialDomain   = query.Questions[0].Domain
-		rootServerIndex = rand.Intn(len(RootServers))
-		rootServerIP    = RootServers[rootServerIndex]
-		addr            = net.UDPAddr{IP: rootServerIP, Port: 53}
-	)
+// resolution keeps track of the work done for a single query. Following
+// the CNAMEs and looking up the addresses of the name servers both start
+// nested lookups, which, without the limits, would recurse forever on a
+// CNAME loop split across responses or a name server that can only be
+// reached through itself.
+type resolution struct {
+	// Number of CNAMEs followed in the current chain.
+	cnames int
 
-	for {
-		var (
-			response types.Packet
-			err      error
-		)
-
-		cacheDomain := query.Questions[0].Domain
-		packetRecords, ok := cache.Get(cacheDomain, addr.IP)
-		if ok {
-			response = constructResponse(query, packetRecords)
-		} else {
-			response, err = sendQuery(query, addr)
-			if err != nil {
-				return types.Packet{}, err
-			}
+	// Nesting depth and the total number of the name server lookups.
+	depth   int
+	lookups int
+
+	// Name servers whose addresses are being looked up.
+	pending map[string]bool
+
+	// Exchanges shared with the other queries to the same cache.
+	flights *flightGroup
+}
+
+func newResolution(flights *flightGroup) *resolution {
+	return &resolution{pending: make(map[string]bool), flights: flights}
+}
+
+// followCnames counts the CNAMEs leading to the next name in the chain.
+func (r *resolution) followCnames(records []types.Record) error {
+	for _, record := range records {
+		if record.Type == types.RecordTypeCNAME {
+			r.cnames += 1
+		}
+	}
+
+	if r.cnames > maxCnameChainLength {
+		return ErrCnameChainTooLong
+	}
+	return nil
+}
+
+// nameServers are the candidates to send a query to. Hosts without glue
+// are only resolved if none of the known addresses has answered.
+type nameServers struct {
+	addrs []net.IP
+	hosts []string
+}
+
+func rootNameServers() nameServers {
+	addrs := make([]net.IP, 0, len(RootServers)+len(RootServersV6))
+	for _, i := range rand.Perm(len(RootServers)) {
+		addrs = append(addrs, RootServers[i], RootServersV6[i])
+	}
+	return nameServers{addrs: addrs}
+}
+
+// Lookup resolves the client's query. The header of the response is the
+// resolver's own, the one of the upstream response describes the exchange
+// with the name server (e.g. an authoritative answer to a non-recursive
+// query), so only the response code is kept from it.
+func Lookup(ctx context.Context, query types.Packet, cache *cache.DnsCache, policy AddressPolicy) (types.Packet, error) {
+	return lookupQuery(ctx, query, cache, policy, newFlightGroup())
+}
+
+// lookupQuery is Lookup sharing the upstream exchanges with the other
+// lookups of the flight group, which have to use the same cache.
+func lookupQuery(ctx context.Context, query types.Packet, cache *cache.DnsCache, policy AddressPolicy, flights *flightGroup) (types.Packet, error) {
+	response, err := lookup(ctx, query, cache, policy, newResolution(flights))
+	if err != nil {
+		return types.Packet{}, err
+	}
+
+	clientResponse := constructResponse(query, response.Records)
+	clientResponse.Header.ResponseCode = response.Header.ResponseCode
+	return clientResponse, nil
+}
+
+func lookup(ctx context.Context, query types.Packet, cache *cache.DnsCache, policy AddressPolicy, r *resolution) (types.Packet, error) {
+	question := query.Questions[0]
+
+	response, domain, complete := cachedResponse(cache, query)
+	if complete {
+		return response, nil
+	}
+
+	if len(response.Records.Answers) > 0 {
+		err := r.followCnames(response.Records.Answers)
+		if err != nil {
+			return types.Packet{}, err
+		}
 
-			cache.Set(cacheDomain, addr.IP, response.Records)
+		cnameQuery := constructQuery(domain, question.Type)
+		cnameResponse, err := lookup(ctx, cnameQuery, cache, policy, r)
+		if err != nil {
+			return types.Packet{}, err
+		}
+
+		return mergeCnameResponse(response, cnameResponse), nil
+	}
+
+	return lookupUpstream(ctx, query, cache, policy, r)
+}
+
+// lookupUpstream resolves the query starting from the closest name servers
+// known, ignoring the cached answer to the query itself.
+func lookupUpstream(ctx context.Context, query types.Packet, cache *cache.DnsCache, policy AddressPolicy, r *resolution) (types.Packet, error) {
+	question := query.Questions[0]
+	servers, zone := closestNameServers(cache, question.Domain)
+
+	for {
+		response, err := queryNameServers(ctx, query, servers, cache, policy, r)
+		if err != nil {
+			return types.Packet{}, err
 		}
 
+		response = sanitizeResponse(question, zone, response)
+		cacheResponse(cache, question, response)
+
 		if response.Header.ResponseCode != types.ResponseCodeNoError {
 			return response, nil
 		}
 
-		if _, ok := getIPv4(response.Records.Answers, initialDomain); ok {
+		domain, complete, err := followCnames(response.Records.Answers, question)
+		if err != nil {
+			return types.Packet{}, err
+		}
+
+		if complete {
 			return response, nil
 		}
 
-		cname, ok := getCname(response.Records.Answers, initialDomain)
-		if ok {
-			cnameQuery := constructQuery(cname)
-			cnameResponse, err := Lookup(cnameQuery, cache)
+		// The chain of CNAMEs leads to a name the server has no data for,
+		// so the resolution starts over for the target preserving the type.
+		if domain != question.Domain {
+			err := r.followCnames(response.Records.Answers)
+			if err != nil {
+				return types.Packet{}, err
+			}
+
+			cnameQuery := constructQuery(domain, question.Type)
+			cnameResponse, err := lookup(ctx, cnameQuery, cache, policy, r)
 			if err != nil {
 				return types.Packet{}, err
 			}
 
-			response.Records.Answers = append(response.Records.Answers, cnameResponse.Records.Answers...)
-			response.Header.AnswerSectionSize += cnameResponse.Header.AnswerSectionSize
+			return mergeCnameResponse(response, cnameResponse), nil
+		}
+
+		if isNoData(response) {
 			return response, nil
 		}
 
-		host, ok := pickNameServer(response.Records.AuthorityRecords)
-		if !ok {
+		hosts := getNameServers(response.Records.AuthorityRecords)
+		if len(hosts) == 0 {
+			if response.Header.AuthoritativeAnswer {
+				return response, nil
+			}
 			return types.Packet{}, ErrUnableToResolve
 		}
 
-		addr.IP, ok = resolveNameServer(response.Records.AdditionalRecords, host)
-		if ok {
-			continue
+		// Nothing but the delegation is left in the authority section of
+		// the sanitized referral.
+		zone = response.Records.AuthorityRecords[0].Domain
+		servers = resolveNameServers(response.Records.AdditionalRecords, hosts, zone)
+	}
+}
+
+// queryNameServers tries the servers one by one until one of them answers.
+// The error of the last attempt is returned if none of them did. Addresses
+// of the hosts without glue are looked up in the order of the policy.
+func queryNameServers(ctx context.Context, query types.Packet, servers nameServers, cache *cache.DnsCache, policy AddressPolicy, r *resolution) (types.Packet, error) {
+	err := ErrUnableToResolve
+
+	for _, ip := range selectNameServers(cache, servers.addrs, policy) {
+		response, queryErr := queryNameServer(ctx, query, ip, cache, r)
+		if queryErr == nil {
+			return response, nil
+		}
+
+		if ctx.Err() != nil {
+			return types.Packet{}, ctx.Err()
+		}
+		err = queryErr
+	}
+
+	for _, host := range servers.hosts {
+		for _, questionType := range policy.questionTypes() {
+			hostQuery := constructQuery(host, questionType)
+			hostResponse, lookupErr := lookupNameServer(ctx, hostQuery, cache, policy, r)
+			if lookupErr != nil {
+				if ctx.Err() != nil {
+					return types.Packet{}, ctx.Err()
+				}
+				err = lookupErr
+				continue
+			}
+
+			domain, _, _ := followCnames(hostResponse.Records.Answers, hostQuery.Questions[0])
+			addrs := getAddresses(hostResponse.Records.Answers, domain)
+
+			for _, ip := range selectNameServers(cache, addrs, policy) {
+				response, queryErr := queryNameServer(ctx, query, ip, cache, r)
+				if queryErr == nil {
+					return response, nil
+				}
+
+				if ctx.Err() != nil {
+					return types.Packet{}, ctx.Err()
+				}
+				err = queryErr
+			}
 		}
+	}
 
-		nsQuery := constructQuery(host)
-		hostResponse, err := Lookup(nsQuery, cache)
+	return types.Packet{}, err
+}
+
+// lookupNameServer looks up the address of the name server. The lookup has
+// its own CNAME chain, but shares the limits on the nested lookups with the
+// resolution it's a part of.
+func lookupNameServer(ctx context.Context, query types.Packet, cache *cache.DnsCache, policy AddressPolicy, r *resolution) (types.Packet, error) {
+	host := strings.ToLower(query.Questions[0].Domain)
+	if r.pending[host] {
+		return types.Packet{}, fmt.Errorf("%w: %s", ErrNameServerLoop, host)
+	}
+
+	if r.depth >= maxLookupDepth {
+		return types.Packet{}, ErrLookupTooDeep
+	}
+
+	r.lookups += 1
+	if r.lookups > maxLookups {
+		return types.Packet{}, ErrTooManyLookups
+	}
+
+	cnames := r.cnames
+	r.pending[host] = true
+	r.depth += 1
+	r.cnames = 0
+
+	defer func() {
+		delete(r.pending, host)
+		r.depth -= 1
+		r.cnames = cnames
+	}()
+
+	return lookup(ctx, query, cache, policy, r)
+}
+
+func queryNameServer(ctx context.Context, query types.Packet, ip net.IP, cache *cache.DnsCache, r *resolution) (types.Packet, error) {
+	key := newFlightKey(query.Questions[0], ip)
+	response, err := r.flights.do(ctx, key, func(ctx context.Context) (types.Packet, error) {
+		return exchange(ctx, query, ip, cache)
+	})
+	if err != nil {
+		return types.Packet{}, err
+	}
+
+	// The response may have been received for a query of another client.
+	response.Header.ID = query.Header.ID
+	response.Questions = query.Questions
+	return response, nil
+}
+
+// exchange sends the query to the server and records how it went: the time
+// it took to answer, the failure or the lack of the EDNS support. The
+// exchange cancelled because nobody waits for it anymore says nothing about
+// the server, so it isn't recorded.
+func exchange(ctx context.Context, query types.Packet, ip net.IP, cache *cache.DnsCache) (types.Packet, error) {
+	ctx, cancel := context.WithTimeout(ctx, UpstreamTimeout)
+	defer cancel()
+
+	info, _ := cache.ServerInfo(ip)
+	addr := net.UDPAddr{IP: ip, Port: nameServerPort}
+
+	start := time.Now()
+	response, err := sendQuery(ctx, constructUpstreamQuery(query, !info.NoEdns), addr)
+	if err != nil {
+		reportFailure(cache, ip, time.Since(start), err)
+		return types.Packet{}, err
+	}
+
+	// Servers that don't implement EDNS respond with an error and without
+	// an OPT record, the query is repeated without it (RFC 6891, section 7).
+	if !info.NoEdns && response.Edns == nil && (response.Header.ResponseCode == types.ResponseCodeFormatError ||
+		response.Header.ResponseCode == types.ResponseCodeNotImplemented) {
+		cache.ReportNoEdns(ip)
+
+		start = time.Now()
+		response, err = sendQuery(ctx, constructUpstreamQuery(query, false), addr)
 		if err != nil {
+			reportFailure(cache, ip, time.Since(start), err)
 			return types.Packet{}, err
 		}
+	}
 
-		addr.IP, ok = getIPv4(hostResponse.Records.Answers, host)
-		if !ok {
-			return types.Packet{}, ErrUnableToResolve
-		}
+	rtt := time.Since(start)
+
+	switch response.Header.ResponseCode {
+	case types.ResponseCodeFormatError, types.ResponseCodeServerFailure,
+		types.ResponseCodeNotImplemented, types.ResponseCodeRefused:
+		cache.ReportFailure(ip, rtt)
+		return types.Packet{}, fmt.Errorf("%w: %s responded with code %d", ErrNameServerFailure, ip, response.Header.ResponseCode)
 	}
+
+	cache.ReportRtt(ip, rtt)
+	return response, nil
 }
 
-func sendQuery(query types.Packet, addr net.UDPAddr) (types.Packet, error) {
-	localAddr := net.UDPAddr{IP: net.IPv4(0, 0, 0, 0), Port: 0}
+func reportFailure(cache *cache.DnsCache, ip net.IP, timeout time.Duration, err error) {
+	if !errors.Is(err, context.Canceled) {
+		cache.ReportFailure(ip, timeout)
+	}
+}
 
-	conn, err := net.DialUDP("udp", &localAddr, &addr)
+func sendQuery(ctx context.Context, query types.Packet, addr net.UDPAddr) (types.Packet, error) {
+	response, err := sendUdpQuery(ctx, query, addr)
 	if err != nil {
 		return types.Packet{}, err
 	}
 
-	queryBytes, err := serde.MarshalPacket(query)
+	if !response.Header.Truncated {
+		return response, nil
+	}
+
+	tcpAddr := net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
+	return sendTcpQuery(ctx, query, tcpAddr)
+}
+
+func sendUdpQuery(ctx context.Context, query types.Packet, addr net.UDPAddr) (types.Packet, error) {
+	conn, err := net.DialUDP("udp", nil, &addr)
 	if err != nil {
 		return types.Packet{}, err
 	}
+	defer conn.Close()
 
-	n, err := conn.Write(queryBytes)
+	stop := watchContext(ctx, conn)
+	defer stop()
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	queryBytes, err := serde.MarshalPacketTo(*buf, query, types.MaxPacketSize)
 	if err != nil {
 		return types.Packet{}, err
 	}
 
+	n, err := conn.Write(queryBytes)
+	if err != nil {
+		return types.Packet{}, contextError(ctx, err)
+	}
+
 	if n != len(queryBytes) {
 		err = fmt.Errorf("unread bytes (server read %d out of %d)", n, len(queryBytes))
 		return types.Packet{}, err
 	}
 
-	responseBytes := make([]byte, 512)
-	n, err = conn.Read(responseBytes)
+	// The query has been sent, so the buffer is reused for the responses.
+	for {
+		n, err = conn.Read(*buf)
+		if err != nil {
+			return types.Packet{}, contextError(ctx, err)
+		}
+
+		response, err := serde.UnmarshalPacket((*buf)[:n])
+		if err != nil {
+			return types.Packet{}, err
+		}
+
+		// Stray datagrams (e.g. late answers to a previous query sent from
+		// the same port) are skipped rather than treated as the answer.
+		if isResponseTo(response, query) {
+			return response, nil
+		}
+	}
+}
+
+func sendTcpQuery(ctx context.Context, query types.Packet, addr net.TCPAddr) (types.Packet, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr.String())
+	if err != nil {
+		return types.Packet{}, err
+	}
+	defer conn.Close()
+
+	stop := watchContext(ctx, conn)
+	defer stop()
+
+	queryBytes, err := serde.MarshalPacket(query, types.MaxTcpPacketSize)
 	if err != nil {
 		return types.Packet{}, err
 	}
 
-	return serde.UnmarshalPacket(responseBytes)
+	err = writeTcpMessage(conn, queryBytes)
+	if err != nil {
+		return types.Packet{}, contextError(ctx, err)
+	}
+
+	for {
+		responseBytes, err := readTcpMessage(conn, nil)
+		if err != nil {
+			return types.Packet{}, contextError(ctx, err)
+		}
+
+		response, err := serde.UnmarshalPacket(responseBytes)
+		if err != nil {
+			return types.Packet{}, err
+		}
+
+		if isResponseTo(response, query) {
+			return response, nil
+		}
+	}
 }
 
-func getIPv4(records []types.Record, domain string) (net.IP, bool) {
+// isResponseTo reports whether the response has the ID of the query and
+// echoes its question (RFC 5452, section 9.1). Servers rejecting the query
+// as malformed may leave the question out.
+func isResponseTo(response, query types.Packet) bool {
+	if response.Header.PacketType != types.PacketTypeResponse || response.Header.ID != query.Header.ID {
+		return false
+	}
+
+	if len(response.Questions) == 0 {
+		return response.Header.ResponseCode == types.ResponseCodeFormatError
+	}
+
+	if len(response.Questions) != 1 {
+		return false
+	}
+
+	actual, expected := response.Questions[0], query.Questions[0]
+	return actual.Type == expected.Type && actual.Class == expected.Class && strings.EqualFold(actual.Domain, expected.Domain)
+}
+
+// watchContext makes blocked reads and writes on the connection return as
+// soon as the context is done. The returned function stops the watch.
+func watchContext(ctx context.Context, conn net.Conn) func() bool {
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+}
+
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// getAddresses returns the addresses from both A and AAAA records.
+func getAddresses(records []types.Record, domain string) []net.IP {
+	addrs := make([]net.IP, 0)
 	for _, record := range records {
-		if record.Type == types.RecordTypeA && record.Domain == domain {
-			return record.Data.(net.IP), true
+		if !strings.EqualFold(record.Domain, domain) {
+			continue
+		}
+
+		switch data := record.Data.(type) {
+		case *types.ARData:
+			addrs = append(addrs, data.IP)
+		case *types.AAAARData:
+			addrs = append(addrs, data.IP)
 		}
 	}
-	return nil, false
+	return addrs
 }
 
 func getCname(records []types.Record, domain string) (string, bool) {
 	for _, record := range records {
-		if record.Type == types.RecordTypeCNAME && record.Domain == domain {
-			return record.Data.(string), true
+		if !strings.EqualFold(record.Domain, domain) {
+			continue
+		}
+
+		if data, ok := record.Data.(*types.CNAMERData); ok {
+			return data.Target, true
 		}
 	}
 	return "", false
 }
 
-func pickNameServer(records []types.Record) (string, bool) {
+func hasAnswer(records []types.Record, domain string, question types.Question) bool {
 	for _, record := range records {
-		if record.Type == types.RecordTypeNS {
-			host := record.Data.(string)
-			return host, true
+		if uint16(record.Type) == uint16(question.Type) &&
+			uint16(record.Class) == uint16(question.Class) &&
+			strings.EqualFold(record.Domain, domain) {
+			return true
 		}
 	}
-	return "", false
+	return false
+}
+
+// followCnames walks the chain of CNAMEs in the answer section starting at
+// the question's domain. It returns the last name in the chain and whether
+// the answer section has the records of the requested type for it.
+func followCnames(records []types.Record, question types.Question) (string, bool, error) {
+	domain := question.Domain
+
+	for range maxCnameChainLength {
+		if hasAnswer(records, domain, question) {
+			return domain, true, nil
+		}
+
+		cname, ok := getCname(records, domain)
+		if !ok {
+			return domain, false, nil
+		}
+
+		domain = cname
+	}
+
+	return "", false, ErrCnameChainTooLong
 }
 
-func resolveNameServer(records []types.Record, host string) (net.IP, bool) {
+// isNoData reports whether the response says that the name exists but has
+// no records of the requested type (RFC 2308, section 2.2).
+func isNoData(response types.Packet) bool {
+	if response.Header.ResponseCode != types.ResponseCodeNoError {
+		return false
+	}
+
+	for _, record := range response.Records.AuthorityRecords {
+		if record.Type == types.RecordTypeSOA {
+			return true
+		}
+	}
+	return false
+}
+
+func getNameServers(records []types.Record) []string {
+	hosts := make([]string, 0)
 	for _, record := range records {
-		if record.Type == types.RecordTypeA && record.Domain == host {
-			ip := record.Data.(net.IP)
-			return ip, true
+		if data, ok := record.Data.(*types.NSRData); ok {
+			hosts = append(hosts, data.Host)
 		}
 	}
-	return nil, false
+	return hosts
 }
 
-func constructQuery(domain string) types.Packet {
+// resolveNameServers matches the hosts of the zone's name servers with the
+// glue. The hosts inside the zone without the glue can't be reached, so
+// they are left out.
+func resolveNameServers(records []types.Record, hosts []string, zone string) nameServers {
+	var servers nameServers
+	for _, host := range hosts {
+		addrs := getAddresses(records, host)
+		if len(addrs) > 0 {
+			servers.addrs = append(servers.addrs, addrs...)
+		} else if !isSubdomain(host, zone) {
+			servers.hosts = append(servers.hosts, host)
+		}
+	}
+	return servers
+}
+
+func constructQuery(domain string, questionType types.QuestionType) types.Packet {
 	return types.Packet{
 		Header: types.Header{
-			ID:                  uint16(rand.Intn(math.MaxUint16)),
+			ID:                  randomID(),
 			PacketType:          types.PacketTypeQuery,
 			Opcode:              types.OpcodeQuery,
 			QuestionSectionSize: 1,
@@ -185,13 +633,43 @@ func constructQuery(domain string) types.Packet {
 		Questions: []types.Question{
 			{
 				Domain: domain,
-				Type:   types.QuestionTypeA,
+				Type:   questionType,
 				Class:  types.QuestionClassIN,
 			},
 		},
 	}
 }
 
+// constructUpstreamQuery strips everything but the question from the
+// client's query. Each exchange gets an ID of its own, so the one chosen by
+// the client can't be used to spoof the response (RFC 5452, section 4.3).
+// The OPT record advertises a larger buffer than the plain 512 bytes, so
+// fewer answers have to be retried over TCP.
+func constructUpstreamQuery(query types.Packet, edns bool) types.Packet {
+	upstreamQuery := types.Packet{
+		Header: types.Header{
+			ID:         randomID(),
+			PacketType: types.PacketTypeQuery,
+			Opcode:     types.OpcodeQuery,
+		},
+		Questions: query.Questions,
+	}
+
+	if edns {
+		upstreamQuery.Edns = &types.Edns{
+			UdpPayloadSize: types.DefaultEdnsPayloadSize,
+			Version:        types.EdnsVersion,
+		}
+	}
+
+	upstreamQuery.UpdateSectionSizes()
+	return upstreamQuery
+}
+
+func randomID() uint16 {
+	return uint16(rand.Intn(math.MaxUint16 + 1))
+}
+
 func constructResponse(query types.Packet, packetRecords types.PacketRecords) types.Packet {
 	return types.Packet{
 		Header: types.Header{
@@ -208,3 +686,34 @@ func constructResponse(query types.Packet, packetRecords types.PacketRecords) ty
 		Records:   packetRecords,
 	}
 }
+
+func constructErrorResponse(query types.Packet, responseCode types.ResponseCode) types.Packet {
+	return types.Packet{
+		Header: types.Header{
+			ID:                  query.Header.ID,
+			PacketType:          types.PacketTypeResponse,
+			Opcode:              query.Header.Opcode,
+			RecursionDesired:    query.Header.RecursionDesired,
+			RecursionAvailable:  true,
+			ResponseCode:        responseCode,
+			QuestionSectionSize: uint16(len(query.Questions)),
+		},
+		Questions: query.Questions,
+		Edns:      responseEdns(query),
+	}
+}
+
+// mergeCnameResponse appends the answer for the CNAME target to the response
+// that contained the CNAME. The status and the authority section of the
+// target's response are kept, so NXDOMAIN and NODATA propagate to the client.
+func mergeCnameResponse(response, cnameResponse types.Packet) types.Packet {
+	response.Header.ResponseCode = cnameResponse.Header.ResponseCode
+	response.Records.Answers = append(response.Records.Answers, cnameResponse.Records.Answers...)
+	response.Records.AuthorityRecords = cnameResponse.Records.AuthorityRecords
+	response.Records.AdditionalRecords = cnameResponse.Records.AdditionalRecords
+
+	response.Header.AnswerSectionSize = uint16(len(response.Records.Answers))
+	response.Header.AuthorityRecordsSectionSize = uint16(len(response.Records.AuthorityRecords))
+	response.Header.AdditionalRecordsSectionSize = uint16(len(response.Records.AdditionalRecords))
+	return response
+}
@@ -0,0 +1,124 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+)
+
+// flightKey identifies the upstream exchange, concurrent queries with the
+// same key share a single exchange with the name server.
+type flightKey struct {
+	domain string
+	qtype  types.QuestionType
+	qclass types.QuestionClass
+	server string
+}
+
+func newFlightKey(question types.Question, ip net.IP) flightKey {
+	return flightKey{
+		domain: strings.ToLower(question.Domain),
+		qtype:  question.Type,
+		qclass: question.Class,
+		server: ip.String(),
+	}
+}
+
+type flight struct {
+	done     chan struct{}
+	response types.Packet
+	err      error
+
+	// Number of the callers waiting for the exchange, which is cancelled
+	// once none is left.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// flightGroup coalesces the exchanges of a single cache, since the result
+// of each exchange is recorded into the cache of the caller starting it.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[flightKey]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[flightKey]*flight)}
+}
+
+// do runs the exchange unless the one with the same key is already in
+// flight, in which case its result is awaited instead. The exchange isn't
+// bound to the context of the caller that started it, so cancelling one of
+// the queries doesn't fail the others, each caller stops waiting as soon as
+// its own context is done. The exchange is only cancelled when all of its
+// callers have left.
+func (g *flightGroup) do(ctx context.Context, key flightKey, exchange func(ctx context.Context) (types.Packet, error)) (types.Packet, error) {
+	g.mu.Lock()
+	f, ok := g.flights[key]
+	if !ok {
+		exchangeCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.flights[key] = f
+
+		go func() {
+			defer cancel()
+			f.response, f.err = exchange(exchangeCtx)
+
+			g.mu.Lock()
+			g.remove(key, f)
+			g.mu.Unlock()
+
+			close(f.done)
+		}()
+	}
+	f.waiters += 1
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		g.leave(key, f)
+		return types.Packet{}, ctx.Err()
+	}
+
+	if f.err != nil {
+		return types.Packet{}, f.err
+	}
+	return clonePacket(f.response), nil
+}
+
+// leave cancels the exchange nobody waits for anymore. The cancelled flight
+// is removed right away, so the next caller starts a new exchange rather
+// than joining the one that is about to fail.
+func (g *flightGroup) leave(key flightKey, f *flight) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	f.waiters -= 1
+	if f.waiters == 0 {
+		f.cancel()
+		g.remove(key, f)
+	}
+}
+
+// remove deletes the flight unless it has already been replaced by a new
+// one with the same key. The caller has to hold the lock.
+func (g *flightGroup) remove(key flightKey, f *flight) {
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+}
+
+// clonePacket copies the sections of the packet, so the callers sharing the
+// response can modify them independently.
+func clonePacket(packet types.Packet) types.Packet {
+	packet.Questions = slices.Clone(packet.Questions)
+	packet.Records.Answers = slices.Clone(packet.Records.Answers)
+	packet.Records.AuthorityRecords = slices.Clone(packet.Records.AuthorityRecords)
+	packet.Records.AdditionalRecords = slices.Clone(packet.Records.AdditionalRecords)
+	return packet
+}
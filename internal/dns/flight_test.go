@@ -0,0 +1,143 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+)
+
+func TestFlightGroupCoalesces(t *testing.T) {
+	group := newFlightGroup()
+	key := newFlightKey(types.Question{Domain: "Example.com.", Type: types.QuestionTypeA, Class: types.QuestionClassIN}, net.IPv4(192, 0, 2, 53))
+
+	var (
+		exchanges atomic.Int32
+		release   = make(chan struct{})
+		wg        sync.WaitGroup
+	)
+
+	exchange := func(ctx context.Context) (types.Packet, error) {
+		exchanges.Add(1)
+		<-release
+		return types.Packet{Records: types.PacketRecords{Answers: make([]types.Record, 1)}}, nil
+	}
+
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			response, err := group.do(context.Background(), key, exchange)
+			if err != nil || len(response.Records.Answers) != 1 {
+				t.Errorf("unexpected result: %v, %v", response, err)
+			}
+		}()
+	}
+
+	for {
+		group.mu.Lock()
+		started := len(group.flights) == 1
+		group.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Gives the rest of the callers time to join the flight.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := exchanges.Load(); n != 1 {
+		t.Fatalf("expected 1 exchange, got %d", n)
+	}
+}
+
+func TestFlightGroupCallerCancel(t *testing.T) {
+	group := newFlightGroup()
+	key := newFlightKey(types.Question{Domain: "example.com.", Type: types.QuestionTypeA, Class: types.QuestionClassIN}, net.IPv4(192, 0, 2, 53))
+
+	release := make(chan struct{})
+	exchange := func(ctx context.Context) (types.Packet, error) {
+		<-release
+		return types.Packet{}, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := group.do(ctx, key, exchange)
+		leader <- err
+	}()
+
+	follower := make(chan error, 1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, err := group.do(context.Background(), key, exchange)
+		follower <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+
+	close(release)
+	if err := <-follower; err != nil {
+		t.Fatalf("cancelled caller failed the shared exchange: %v", err)
+	}
+}
+
+func TestFlightGroupCancelsAbandoned(t *testing.T) {
+	group := newFlightGroup()
+	key := newFlightKey(types.Question{Domain: "example.com.", Type: types.QuestionTypeA, Class: types.QuestionClassIN}, net.IPv4(192, 0, 2, 53))
+
+	var exchanges atomic.Int32
+	cancelled := make(chan struct{})
+	exchange := func(ctx context.Context) (types.Packet, error) {
+		exchanges.Add(1)
+		<-ctx.Done()
+		cancelled <- struct{}{}
+		return types.Packet{}, ctx.Err()
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			group.do(ctx, key, exchange)
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	wg.Wait()
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("exchange kept running after all the callers left")
+	}
+
+	// The next caller doesn't join the cancelled exchange.
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	go func() { <-cancelled }()
+	group.do(ctx, key, exchange)
+
+	if n := exchanges.Load(); n != 2 {
+		t.Fatalf("expected 2 exchanges, got %d", n)
+	}
+}
@@ -2,10 +2,25 @@ package io
 
 import (
 	"errors"
+	"slices"
 
 	"github.com/SergeyCherepiuk/dns-go/internal/utils"
 )
 
+const (
+	minPacketSize = 12
+	maxPacketSize = 65535
+
+	// Limits on the length of a single label and of the whole name in the
+	// wire format, including the length bytes (RFC 1035, section 2.3.4).
+	maxLabelLength = 63
+	maxNameLength  = 255
+
+	// The longest name consists of 127 single-byte labels, so a valid name
+	// never needs more jumps than that.
+	maxPointers = 127
+)
+
 type PacketReader struct {
 	buf []byte
 	pos int
@@ -14,15 +29,25 @@ type PacketReader struct {
 var (
 	ErrInvalidPacketSize = errors.New("invalid packet size")
 	ErrNotEnoughBytes    = errors.New("not enough bytes")
+	ErrPointerLoop       = errors.New("compression pointer loop")
+	ErrForwardPointer    = errors.New("compression pointer to a later position")
+	ErrLabelTooLong      = errors.New("label too long")
+	ErrNameTooLong       = errors.New("name too long")
+	ErrReservedLabelType = errors.New("reserved label type")
+	ErrDotInLabel        = errors.New("label contains a dot")
 )
 
 func NewPacketReader(bytes []byte) (*PacketReader, error) {
-	if len(bytes) < 12 || len(bytes) > 512 {
+	if len(bytes) < minPacketSize || len(bytes) > maxPacketSize {
 		return nil, ErrInvalidPacketSize
 	}
 	return &PacketReader{bytes, 0}, nil
 }
 
+func (r *PacketReader) Pos() int {
+	return r.pos
+}
+
 func (r *PacketReader) ReadUint16() (uint16, error) {
 	if len(r.buf) < r.pos+2 {
 		return 0, ErrNotEnoughBytes
@@ -83,66 +108,88 @@ func (r *PacketReader) ReadBytesAt(n int, pos int) ([]byte, error) {
 	return bytes, nil
 }
 
+// ReadDomain reads the name following the compression pointers, each of
+// which has to point to a prior position in the packet (RFC 1035, section
+// 4.1.4). Every next pointer has to point before the previous one, which
+// rules out the cycles. Only the bytes up to the first pointer are consumed.
+// The name is assembled on the stack, so the only allocation is the
+// resulting string.
 func (r *PacketReader) ReadDomain() (string, error) {
-	domain := make([]byte, 0)
-	pointer := -1
+	var (
+		domain   [maxNameLength]byte
+		end      = 0
+		length   = 0
+		pos      = r.pos
+		pointers = 0
+		lowest   = r.pos
+	)
 
 	for {
-		var (
-			size byte
-			err  error
-		)
-
-		if pointer >= 0 {
-			size, err = r.ReadByteAt(pointer)
-			pointer += 1
-		} else {
-			size, err = r.ReadByte()
-		}
-
+		size, err := r.ReadByteAt(pos)
 		if err != nil {
 			return "", err
 		}
 
-		if size == 0 {
-			break
-		}
-
-		if size&0b11000000 == 0b11000000 {
-			var secondSizeByte byte
+		switch size & 0b11000000 {
+		case 0b11000000:
+			second, err := r.ReadByteAt(pos + 1)
+			if err != nil {
+				return "", err
+			}
 
-			if pointer >= 0 {
-				secondSizeByte, err = r.ReadByteAt(pointer)
-				pointer += 1
-			} else {
-				secondSizeByte, err = r.ReadByte()
+			target := int(utils.BytesToUint16([2]byte{size & 0b00111111, second}))
+			if target > pos {
+				return "", ErrForwardPointer
+			}
+			if target >= lowest {
+				return "", ErrPointerLoop
 			}
 
-			if err != nil {
-				return "", err
+			pointers += 1
+			if pointers > maxPointers {
+				return "", ErrPointerLoop
 			}
+			lowest = target
 
-			pointerBytes := [2]byte{byte(size) & 0b00111111, secondSizeByte}
-			pointer = int(utils.BytesToUint16(pointerBytes))
+			if pointers == 1 {
+				r.pos = pos + 2
+			}
+			pos = target
 			continue
+		case 0b01000000, 0b10000000:
+			return "", ErrReservedLabelType
 		}
 
-		var bytes []byte
+		length += int(size) + 1
+		if length > maxNameLength {
+			return "", ErrNameTooLong
+		}
 
-		if pointer >= 0 {
-			bytes, err = r.ReadBytesAt(int(size), pointer)
-			pointer += int(size)
-		} else {
-			bytes, err = r.ReadBytes(int(size))
+		if size == 0 {
+			break
 		}
 
+		bytes, err := r.ReadBytesAt(int(size), pos+1)
 		if err != nil {
 			return "", err
 		}
 
-		domain = append(domain, bytes...)
-		domain = append(domain, '.')
+		// Names are kept in the dotted form without escaping, so such a
+		// label couldn't be told apart from two separate labels.
+		if slices.Contains(bytes, '.') {
+			return "", ErrDotInLabel
+		}
+
+		// The length check above guarantees the label fits, the dotted form
+		// is never longer than the wire format.
+		end += copy(domain[end:], bytes)
+		domain[end] = '.'
+		end += 1
+		pos += int(size) + 1
 	}
 
-	return string(domain), nil
+	if pointers == 0 {
+		r.pos = pos + 1
+	}
+	return string(domain[:end]), nil
 }
@@ -0,0 +1,90 @@
+package io
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// packetWithName returns the packet consisting of the 12-byte header filled
+// with zeroes followed by the given bytes, the name is read at offset 12.
+func packetWithName(name ...byte) []byte {
+	return append(make([]byte, 12), name...)
+}
+
+func TestReadDomain(t *testing.T) {
+	packet := packetWithName(
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		3, 'w', 'w', 'w', 0xC0, 12,
+	)
+
+	reader, err := NewPacketReader(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.pos = 12
+
+	domain, err := reader.ReadDomain()
+	if err != nil || domain != "example.com." || reader.Pos() != 25 {
+		t.Fatalf("expected example.com. ending at 25, got %q at %d (%v)", domain, reader.Pos(), err)
+	}
+
+	domain, err = reader.ReadDomain()
+	if err != nil || domain != "www.example.com." || reader.Pos() != 31 {
+		t.Fatalf("expected www.example.com. ending at 31, got %q at %d (%v)", domain, reader.Pos(), err)
+	}
+}
+
+func TestReadDomainMalformed(t *testing.T) {
+	longName := make([]byte, 0)
+	for range 5 {
+		longName = append(longName, 63)
+		longName = append(longName, strings.Repeat("a", 63)...)
+	}
+	longName = append(longName, 0)
+
+	tests := map[string]struct {
+		name []byte
+		err  error
+	}{
+		"pointer to itself":   {[]byte{0xC0, 12}, ErrPointerLoop},
+		"forward pointer":     {[]byte{0xC0, 14, 0}, ErrForwardPointer},
+		"pointer cycle":       {[]byte{1, 'a', 0xC0, 12}, ErrPointerLoop},
+		"name too long":       {longName, ErrNameTooLong},
+		"extended label type": {[]byte{0x41, 'a', 0}, ErrReservedLabelType},
+		"reserved label type": {[]byte{0x80, 0}, ErrReservedLabelType},
+		"truncated label":     {[]byte{5, 'a', 'b'}, ErrNotEnoughBytes},
+		"dot in label":        {[]byte{3, 'a', '.', 'b', 0}, ErrDotInLabel},
+		"truncated pointer":   {[]byte{0xC0}, ErrNotEnoughBytes},
+	}
+
+	for name, test := range tests {
+		reader, err := NewPacketReader(packetWithName(test.name...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader.pos = 12
+
+		_, err = reader.ReadDomain()
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", name, test.err, err)
+		}
+	}
+}
+
+func TestWriteDomainLimits(t *testing.T) {
+	tests := map[string]error{
+		strings.Repeat("a", 63) + ".example.":               nil,
+		strings.Repeat("a", 64) + ".example.":               ErrLabelTooLong,
+		strings.Repeat(strings.Repeat("a", 63)+".", 3) + "": nil,
+		strings.Repeat(strings.Repeat("a", 63)+".", 4) + "": ErrNameTooLong,
+	}
+
+	for domain, expected := range tests {
+		writer := NewPacketWriter(maxPacketSize)
+		err := writer.WriteDomain(domain)
+		if !errors.Is(err, expected) {
+			t.Errorf("%d-byte domain: expected %v, got %v", len(domain), expected, err)
+		}
+	}
+}
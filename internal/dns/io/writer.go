@@ -4,14 +4,22 @@ import (
 	"errors"
 	"strings"
 
-	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
 	"github.com/SergeyCherepiuk/dns-go/internal/utils"
 )
 
+// Compression pointers have 14 bits for the offset, so the names written
+// further into the packet can't be pointed to.
+const maxPointerOffset = 0x3FFF
+
 type PacketWriter struct {
-	buf   []byte
-	pos   int
-	cache map[int]string
+	buf     []byte
+	pos     int
+	maxSize int
+
+	// Offsets of the names written so far, including all their suffixes,
+	// keyed by the lowercased name, since the names are compared
+	// case-insensitively (RFC 1035, section 2.3.3).
+	names map[string]int
 }
 
 var (
@@ -19,16 +27,31 @@ var (
 	ErrIndexOutOfBound = errors.New("index out of bound")
 )
 
-func NewPacketWriter() *PacketWriter {
-	return &PacketWriter{
-		buf:   make([]byte, 0),
-		pos:   0,
-		cache: make(map[int]string),
-	}
+func NewPacketWriter(maxSize int) *PacketWriter {
+	return NewPacketWriterBuffer(nil, maxSize)
+}
+
+// NewPacketWriterBuffer returns the writer that writes into the given
+// slice starting from its beginning, so the buffer is only reallocated if
+// its capacity is less than the size of the packet.
+func NewPacketWriterBuffer(buf []byte, maxSize int) *PacketWriter {
+	w := &PacketWriter{names: make(map[string]int)}
+	w.Reset(buf, maxSize)
+	return w
+}
+
+// Reset makes the writer write a new packet into the given slice, keeping
+// the memory allocated for the compression table, so the writer can be
+// reused across packets.
+func (w *PacketWriter) Reset(buf []byte, maxSize int) {
+	w.buf = buf[:0]
+	w.pos = 0
+	w.maxSize = min(maxSize, maxPacketSize)
+	clear(w.names)
 }
 
 func (w *PacketWriter) WriteUint16(uint16 uint16) error {
-	if types.MaxPacketSize < w.pos+2 {
+	if w.maxSize < w.pos+2 {
 		return ErrTooManyBytes
 	}
 
@@ -39,7 +62,7 @@ func (w *PacketWriter) WriteUint16(uint16 uint16) error {
 }
 
 func (w *PacketWriter) WriteUint32(uint32 uint32) error {
-	if types.MaxPacketSize < w.pos+4 {
+	if w.maxSize < w.pos+4 {
 		return ErrTooManyBytes
 	}
 
@@ -50,7 +73,7 @@ func (w *PacketWriter) WriteUint32(uint32 uint32) error {
 }
 
 func (w *PacketWriter) WriteByte(byte byte) error {
-	if types.MaxPacketSize < w.pos+1 {
+	if w.maxSize < w.pos+1 {
 		return ErrTooManyBytes
 	}
 
@@ -60,7 +83,7 @@ func (w *PacketWriter) WriteByte(byte byte) error {
 }
 
 func (w *PacketWriter) WriteBytes(bytes []byte) error {
-	if types.MaxPacketSize < w.pos+len(bytes) {
+	if w.maxSize < w.pos+len(bytes) {
 		return ErrTooManyBytes
 	}
 
@@ -69,65 +92,168 @@ func (w *PacketWriter) WriteBytes(bytes []byte) error {
 	return nil
 }
 
-func (w *PacketWriter) formatDomain(domain string) []byte {
-	var bytes []byte
-
-	subdomains := strings.Split(domain, ".")
-	for i, subdomain := range subdomains {
-		joined := strings.Join(subdomains[i:], ".")
+// validateDomain checks the domain against the limits ReadDomain enforces,
+// so the written names can always be read back.
+func validateDomain(domain string) error {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return nil
+	}
 
-		pointer, ok := utils.KeyByValue(w.cache, joined)
-		if ok {
-			pointerWithPrefix := pointer | 0b11000000_00000000
-			pointerBytes := utils.Uint16ToBytes(uint16(pointerWithPrefix))
-			bytes = append(bytes, pointerBytes[:]...)
-			break
+	length := 1
+	for domain != "" {
+		label, rest, _ := strings.Cut(domain, ".")
+		if len(label) > maxLabelLength {
+			return ErrLabelTooLong
 		}
+		length += len(label) + 1
+		domain = rest
+	}
 
-		size := byte(len(subdomain))
-		bytes = append(bytes, size)
-		bytes = append(bytes, subdomain...)
+	if length > maxNameLength {
+		return ErrNameTooLong
 	}
+	return nil
+}
 
-	return bytes
+// WriteDomain writes the domain replacing the longest suffix already
+// present in the packet with a pointer to it. It's meant for the owner names
+// and the names in the RDATA of the well-known types (RFC 3597, section 4).
+func (w *PacketWriter) WriteDomain(domain string) error {
+	return w.writeDomain(domain, true)
 }
 
-func (w *PacketWriter) cacheDomain(domain string) {
-	initialDomainLength := len(domain)
+// WriteDomainUncompressed writes all the labels of the domain, it's used
+// for the fields that must not be compressed (e.g. SRV target, RFC 2782).
+func (w *PacketWriter) WriteDomainUncompressed(domain string) error {
+	return w.writeDomain(domain, false)
+}
 
-	for {
-		_, ok := utils.KeyByValue(w.cache, domain)
-		if domain != "" && !ok {
-			pointer := initialDomainLength - len(domain) + w.pos
-			w.cache[pointer] = domain
+func (w *PacketWriter) writeDomain(domain string, compress bool) error {
+	err := validateDomain(domain)
+	if err != nil {
+		return err
+	}
+
+	domain = strings.TrimSuffix(domain, ".")
+
+	// The labels are appended right to the buffer, which is rolled back if
+	// the name doesn't fit.
+	var (
+		start  = w.pos
+		suffix = domain
+	)
+
+	for suffix != "" {
+		if compress {
+			offset, ok := w.lookupName(suffix)
+			if ok {
+				err = w.WriteUint16(uint16(offset) | 0b11000000_00000000)
+				break
+			}
 		}
 
-		index := strings.Index(domain, ".")
-		if index == -1 {
+		label, rest, _ := strings.Cut(suffix, ".")
+		err = w.writeLabel(label)
+		if err != nil {
 			break
 		}
+		suffix = rest
+	}
 
-		domain = domain[index+1:]
+	if err == nil && suffix == "" {
+		err = w.WriteByte(0)
 	}
+
+	if err != nil {
+		w.buf = w.buf[:start]
+		w.pos = start
+		return err
+	}
+
+	w.addNames(domain, suffix, start)
+	return nil
 }
 
-func (w *PacketWriter) WriteDomain(domain string) error {
-	bytes := w.formatDomain(domain)
-	w.cacheDomain(domain)
-	return w.WriteBytes(bytes)
+func (w *PacketWriter) writeLabel(label string) error {
+	if w.maxSize < w.pos+1+len(label) {
+		return ErrTooManyBytes
+	}
+
+	w.buf = append(w.buf, byte(len(label)))
+	w.buf = append(w.buf, label...)
+	w.pos += 1 + len(label)
+	return nil
 }
 
-func (w *PacketWriter) WriteDomainWithLength(domain string) error {
-	bytes := w.formatDomain(domain)
+// foldName lowercases the ASCII letters of the name into the buffer. Only
+// ASCII is folded, as the names are compared in DNS (RFC 4343, section 3),
+// any other byte is kept as is, so the distinct names never share a key.
+func foldName(buf *[maxNameLength]byte, name string) ([]byte, bool) {
+	if len(name) > len(buf) {
+		return nil, false
+	}
 
-	length := uint16(len(bytes))
-	err := w.WriteUint16(length)
-	if err != nil {
-		return err
+	for i := range len(name) {
+		c := name[i]
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		buf[i] = c
+	}
+	return buf[:len(name)], true
+}
+
+// lookupName returns the offset of the name written earlier. The name is
+// folded into a buffer on the stack, which keeps the lookup free of
+// allocations.
+func (w *PacketWriter) lookupName(name string) (int, bool) {
+	var buf [maxNameLength]byte
+	key, ok := foldName(&buf, name)
+	if !ok {
+		return 0, false
 	}
 
-	w.cacheDomain(domain)
-	return w.WriteBytes(bytes)
+	offset, ok := w.names[string(key)]
+	return offset, ok
+}
+
+// addNames remembers the offsets of the suffixes of the domain written at
+// the given position, up to the suffix replaced with a pointer.
+func (w *PacketWriter) addNames(domain, pointedSuffix string, pos int) {
+	var buf [maxNameLength]byte
+
+	for suffix := domain; suffix != "" && suffix != pointedSuffix; {
+		offset := pos + len(domain) - len(suffix)
+		if offset > maxPointerOffset {
+			return
+		}
+
+		key, ok := foldName(&buf, suffix)
+		if !ok {
+			return
+		}
+
+		if _, ok := w.names[string(key)]; !ok {
+			w.names[string(key)] = offset
+		}
+
+		_, suffix, _ = strings.Cut(suffix, ".")
+	}
+}
+
+func (w *PacketWriter) Pos() int {
+	return w.pos
+}
+
+func (w *PacketWriter) SetUint16At(pos int, uint16 uint16) error {
+	if pos < 0 || w.pos < pos+2 {
+		return ErrIndexOutOfBound
+	}
+
+	bytes := utils.Uint16ToBytes(uint16)
+	copy(w.buf[pos:pos+2], bytes[:])
+	return nil
 }
 
 func (w *PacketWriter) Bytes() []byte {
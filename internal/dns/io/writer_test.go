@@ -0,0 +1,138 @@
+package io
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteDomainCompression(t *testing.T) {
+	w := NewPacketWriter(maxPacketSize)
+
+	for _, domain := range []string{"Example.COM.", "www.example.com.", "example.com.", "."} {
+		err := w.WriteDomain(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []byte{
+		7, 'E', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'C', 'O', 'M', 0,
+		3, 'w', 'w', 'w', 0xC0, 0,
+		0xC0, 0,
+		0,
+	}
+	if !bytes.Equal(w.Bytes(), expected) {
+		t.Fatalf("expected %v, got %v", expected, w.Bytes())
+	}
+}
+
+func TestWriteDomainUncompressed(t *testing.T) {
+	w := NewPacketWriter(maxPacketSize)
+
+	err := w.WriteDomain("example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.WriteDomainUncompressed("sip.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(w.Bytes()) != 13+17 {
+		t.Fatalf("uncompressed name was compressed: %v", w.Bytes())
+	}
+}
+
+func TestWriteDomainPointerRange(t *testing.T) {
+	w := NewPacketWriter(maxPacketSize)
+
+	err := w.WriteBytes(make([]byte, maxPointerOffset+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		err := w.WriteDomain("example.com.")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(w.Bytes()) != maxPointerOffset+1+2*13 {
+		t.Fatal("name beyond the pointer range was pointed to")
+	}
+}
+
+func TestWriteDomainFailureKeepsNames(t *testing.T) {
+	w := NewPacketWriter(minPacketSize)
+
+	err := w.WriteDomain(strings.Repeat("a", 20) + ".")
+	if err == nil {
+		t.Fatal("expected the write to fail")
+	}
+
+	if len(w.names) != 0 {
+		t.Fatalf("names of the failed write were kept: %v", w.names)
+	}
+
+	if len(w.Bytes()) != 0 || w.Pos() != 0 {
+		t.Fatalf("bytes of the failed write were kept: %v", w.Bytes())
+	}
+}
+
+func TestPacketWriterBuffer(t *testing.T) {
+	buf := make([]byte, 64)
+	w := NewPacketWriterBuffer(buf, maxPacketSize)
+
+	err := w.WriteDomain("example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if &w.Bytes()[0] != &buf[0] {
+		t.Fatal("packet wasn't written into the given buffer")
+	}
+
+	w.Reset(buf, maxPacketSize)
+
+	err = w.WriteDomain("example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(w.Bytes()) != 13 {
+		t.Fatalf("name from the previous packet was pointed to: %v", w.Bytes())
+	}
+}
+
+func TestWriteDomainFoldsOnlyAscii(t *testing.T) {
+	tests := [][2]string{
+		{"\xc3\x89.com.", "\xc3\xa9.com."},
+		{"\xc0.net.", "\xef\xbf\xbd.net."},
+	}
+
+	for _, test := range tests {
+		w := NewPacketWriter(maxPacketSize)
+
+		for _, domain := range test {
+			err := w.WriteDomain(domain)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		r := &PacketReader{buf: w.Bytes()}
+		for _, expected := range test {
+			domain, err := r.ReadDomain()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if domain != expected {
+				t.Fatalf("expected %q, got %q", expected, domain)
+			}
+		}
+	}
+}
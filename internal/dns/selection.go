@@ -0,0 +1,107 @@
+package dns
+
+import (
+	"cmp"
+	"math/rand"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/cache"
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+)
+
+// AddressPolicy decides which address families are used to reach the name
+// servers. With one of the families preferred, the addresses of the other
+// one are only tried once all the preferred ones have failed.
+type AddressPolicy int
+
+const (
+	PreferIPv4 AddressPolicy = iota
+	PreferIPv6
+	IPv4Only
+	IPv6Only
+)
+
+// questionTypes returns the types of the address records to look up for
+// the name servers without glue, in the order of preference.
+func (p AddressPolicy) questionTypes() []types.QuestionType {
+	switch p {
+	case PreferIPv6:
+		return []types.QuestionType{types.QuestionTypeAAAA, types.QuestionTypeA}
+	case IPv4Only:
+		return []types.QuestionType{types.QuestionTypeA}
+	case IPv6Only:
+		return []types.QuestionType{types.QuestionTypeAAAA}
+	default:
+		return []types.QuestionType{types.QuestionTypeA, types.QuestionTypeAAAA}
+	}
+}
+
+const (
+	// Servers never asked before are given a random RTT below this value,
+	// so they are tried early on and get measured (as BIND does it).
+	unknownServerRtt = 10 * time.Millisecond
+
+	// Probability of trying a random server first, which gives the slow
+	// or failed servers a chance to show that they've recovered.
+	exploreProbability = 0.05
+)
+
+// selectNameServers drops the addresses not allowed by the policy and
+// orders the rest, the preferred family goes first.
+func selectNameServers(c *cache.DnsCache, addrs []net.IP, policy AddressPolicy) []net.IP {
+	var ipv4, ipv6 []net.IP
+	for _, ip := range addrs {
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, ip)
+		} else {
+			ipv6 = append(ipv6, ip)
+		}
+	}
+
+	switch policy {
+	case PreferIPv6:
+		return append(orderNameServers(c, ipv6), orderNameServers(c, ipv4)...)
+	case IPv4Only:
+		return orderNameServers(c, ipv4)
+	case IPv6Only:
+		return orderNameServers(c, ipv6)
+	default:
+		return append(orderNameServers(c, ipv4), orderNameServers(c, ipv6)...)
+	}
+}
+
+// orderNameServers returns the addresses ordered from the fastest server to
+// the slowest one according to the smoothed RTTs from the cache.
+func orderNameServers(c *cache.DnsCache, addrs []net.IP) []net.IP {
+	type candidate struct {
+		ip  net.IP
+		rtt time.Duration
+	}
+
+	candidates := make([]candidate, len(addrs))
+	for i, ip := range addrs {
+		info, ok := c.ServerInfo(ip)
+		if ok {
+			candidates[i] = candidate{ip, info.Srtt}
+		} else {
+			candidates[i] = candidate{ip, time.Duration(rand.Int63n(int64(unknownServerRtt)))}
+		}
+	}
+
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		return cmp.Compare(a.rtt, b.rtt)
+	})
+
+	if len(candidates) > 1 && rand.Float64() < exploreProbability {
+		i := 1 + rand.Intn(len(candidates)-1)
+		candidates[0], candidates[i] = candidates[i], candidates[0]
+	}
+
+	ordered := make([]net.IP, len(candidates))
+	for i, candidate := range candidates {
+		ordered[i] = candidate.ip
+	}
+	return ordered
+}
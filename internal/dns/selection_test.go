@@ -0,0 +1,81 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/cache"
+)
+
+func TestOrderNameServers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := cache.NewDnsCache(ctx, cache.Config{})
+
+	var (
+		slow    = net.IPv4(192, 0, 2, 1)
+		fast    = net.IPv4(192, 0, 2, 2)
+		dead    = net.IPv4(192, 0, 2, 3)
+		unknown = net.IPv4(192, 0, 2, 4)
+	)
+
+	c.ReportRtt(slow, 300*time.Millisecond)
+	c.ReportRtt(fast, 20*time.Millisecond)
+	c.ReportFailure(dead, UpstreamTimeout)
+
+	addrs := []net.IP{dead, slow, fast, unknown}
+	expected := []net.IP{unknown, fast, slow, dead}
+
+	// The order is random once in a while, so the most frequent one wins.
+	matches := 0
+	for range 100 {
+		ordered := orderNameServers(c, addrs)
+
+		match := true
+		for i := range expected {
+			match = match && ordered[i].Equal(expected[i])
+		}
+		if match {
+			matches += 1
+		}
+	}
+
+	if matches < 80 {
+		t.Fatalf("expected servers ordered by RTT, got %d matches out of 100", matches)
+	}
+}
+
+func TestSelectNameServers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := cache.NewDnsCache(ctx, cache.Config{})
+
+	var (
+		ipv4 = net.IPv4(192, 0, 2, 1)
+		ipv6 = net.ParseIP("2001:db8::1")
+	)
+
+	tests := map[AddressPolicy][]net.IP{
+		PreferIPv4: {ipv4, ipv6},
+		PreferIPv6: {ipv6, ipv4},
+		IPv4Only:   {ipv4},
+		IPv6Only:   {ipv6},
+	}
+
+	for policy, expected := range tests {
+		selected := selectNameServers(c, []net.IP{ipv6, ipv4}, policy)
+		if len(selected) != len(expected) {
+			t.Fatalf("policy %d: expected %v, got %v", policy, expected, selected)
+		}
+
+		for i := range expected {
+			if !selected[i].Equal(expected[i]) {
+				t.Fatalf("policy %d: expected %v, got %v", policy, expected, selected)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package serde
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+)
+
+// largeResponse returns the referral-like response with the given number of
+// name servers, each with the glue, similar to the responses of TLD servers.
+func largeResponse(servers int) types.Packet {
+	packet := types.Packet{
+		Header:    types.Header{ID: 1, PacketType: types.PacketTypeResponse},
+		Questions: []types.Question{{Domain: "www.example.com.", Type: types.QuestionTypeA, Class: types.QuestionClassIN}},
+	}
+
+	for i := range servers {
+		host := fmt.Sprintf("ns%d.Example-Servers.net.", i)
+		packet.Records.AuthorityRecords = append(packet.Records.AuthorityRecords, types.Record{
+			Domain: "example.com.",
+			Type:   types.RecordTypeNS,
+			Class:  types.RecordClassIN,
+			Ttl:    172800,
+			Data:   &types.NSRData{Host: host},
+		})
+		packet.Records.AdditionalRecords = append(packet.Records.AdditionalRecords, types.Record{
+			Domain: host,
+			Type:   types.RecordTypeA,
+			Class:  types.RecordClassIN,
+			Ttl:    172800,
+			Data:   &types.ARData{IP: net.IPv4(192, 0, 2, byte(i))},
+		}, types.Record{
+			Domain: host,
+			Type:   types.RecordTypeAAAA,
+			Class:  types.RecordClassIN,
+			Ttl:    172800,
+			Data:   &types.AAAARData{IP: net.ParseIP(fmt.Sprintf("2001:db8::%x", i))},
+		})
+	}
+
+	packet.UpdateSectionSizes()
+	return packet
+}
+
+func BenchmarkMarshalPacket(b *testing.B) {
+	for _, servers := range []int{4, 32, 256} {
+		packet := largeResponse(servers)
+
+		b.Run(fmt.Sprintf("servers=%d", servers), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				_, err := MarshalPacket(packet, types.MaxTcpPacketSize)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMarshalPacketTo reuses the same buffer, so the only allocations
+// left are the keys of the compression table.
+func BenchmarkMarshalPacketTo(b *testing.B) {
+	for _, servers := range []int{4, 32, 256} {
+		packet := largeResponse(servers)
+		buf := make([]byte, types.MaxTcpPacketSize)
+
+		b.Run(fmt.Sprintf("servers=%d", servers), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				_, err := MarshalPacketTo(buf, packet, types.MaxTcpPacketSize)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUnmarshalPacket(b *testing.B) {
+	for _, servers := range []int{4, 32, 256} {
+		bytes, err := MarshalPacket(largeResponse(servers), types.MaxTcpPacketSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("servers=%d", servers), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				_, err := UnmarshalPacket(bytes)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package serde
+
+import (
+	"errors"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+	"github.com/SergeyCherepiuk/dns-go/internal/utils"
+)
+
+var (
+	ErrInvalidEdns  = errors.New("invalid OPT record")
+	ErrMultipleEdns = errors.New("more than one OPT record")
+)
+
+const dnssecOkBit = 1 << 15
+
+// The OPT pseudo-record reuses the fields of a regular record: the class
+// holds the UDP payload size and the TTL holds the extended response code,
+// the version and the flags (RFC 6891, section 6.1.2).
+
+func ednsToRecord(edns types.Edns) types.Record {
+	ttl := uint32(edns.ExtendedResponseCode)<<24 | uint32(edns.Version)<<16
+	if edns.DnssecOk {
+		ttl |= dnssecOkBit
+	}
+
+	var options []byte
+	for _, option := range edns.Options {
+		code := utils.Uint16ToBytes(option.Code)
+		length := utils.Uint16ToBytes(uint16(len(option.Data)))
+
+		options = append(options, code[:]...)
+		options = append(options, length[:]...)
+		options = append(options, option.Data...)
+	}
+
+	return types.Record{
+		Domain: "",
+		Type:   types.RecordTypeOPT,
+		Class:  types.RecordClass(edns.UdpPayloadSize),
+		Ttl:    ttl,
+		Data:   &types.UnknownRData{RecordType: types.RecordTypeOPT, Bytes: options},
+	}
+}
+
+func ednsFromRecord(record types.Record) (types.Edns, error) {
+	if record.Domain != "" {
+		return types.Edns{}, ErrInvalidEdns
+	}
+
+	edns := types.Edns{
+		UdpPayloadSize:       uint16(record.Class),
+		ExtendedResponseCode: uint8(record.Ttl >> 24),
+		Version:              uint8(record.Ttl >> 16),
+		DnssecOk:             record.Ttl&dnssecOkBit != 0,
+	}
+
+	data, ok := record.Data.(*types.UnknownRData)
+	if !ok {
+		return types.Edns{}, ErrInvalidEdns
+	}
+
+	options := data.Bytes
+	for len(options) > 0 {
+		if len(options) < 4 {
+			return types.Edns{}, ErrInvalidEdns
+		}
+
+		code := utils.BytesToUint16([2]byte(options[0:2]))
+		length := int(utils.BytesToUint16([2]byte(options[2:4])))
+		if len(options) < 4+length {
+			return types.Edns{}, ErrInvalidEdns
+		}
+
+		option := types.EdnsOption{Code: code, Data: options[4 : 4+length]}
+		edns.Options = append(edns.Options, option)
+		options = options[4+length:]
+	}
+
+	return edns, nil
+}
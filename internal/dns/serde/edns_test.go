@@ -0,0 +1,93 @@
+package serde
+
+import (
+	"net"
+	"testing"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+	"github.com/SergeyCherepiuk/dns-go/internal/utils"
+)
+
+func TestEdnsRoundTrip(t *testing.T) {
+	packet := types.Packet{
+		Header: types.Header{ID: 1, QuestionSectionSize: 1},
+		Questions: []types.Question{
+			{Domain: "example.com.", Type: types.QuestionTypeA, Class: types.QuestionClassIN},
+		},
+		Records: types.PacketRecords{
+			AdditionalRecords: []types.Record{
+				{
+					Domain: "ns.example.com.",
+					Type:   types.RecordTypeA,
+					Class:  types.RecordClassIN,
+					Ttl:    60,
+					Data:   &types.ARData{IP: net.IPv4(192, 0, 2, 53)},
+				},
+			},
+		},
+		Edns: &types.Edns{
+			UdpPayloadSize:       4096,
+			ExtendedResponseCode: 1,
+			Version:              0,
+			DnssecOk:             true,
+			Options: []types.EdnsOption{
+				{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+				{Code: 12, Data: []byte{}},
+			},
+		},
+	}
+	packet.UpdateSectionSizes()
+
+	bytes, err := MarshalPacket(packet, types.MaxPacketSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := UnmarshalPacket(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := make(utils.DiffEntries, 0)
+	entries = append(entries, utils.Diff(actual.Header, packet.Header)...)
+	entries = append(entries, utils.Diff(len(actual.Records.AdditionalRecords), 1)...)
+	entries = append(entries, utils.Diff(*actual.Edns, *packet.Edns)...)
+
+	if len(entries) > 0 {
+		t.Fatal(entries.String())
+	}
+}
+
+func TestMultipleEdns(t *testing.T) {
+	opt := ednsToRecord(types.Edns{UdpPayloadSize: 1232})
+
+	packet := types.Packet{
+		Header: types.Header{AdditionalRecordsSectionSize: 2},
+		Records: types.PacketRecords{
+			AdditionalRecords: []types.Record{opt, opt},
+		},
+	}
+
+	bytes, err := MarshalPacket(packet, types.MaxPacketSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = UnmarshalPacket(bytes)
+	if err != ErrMultipleEdns {
+		t.Fatalf("expected %v, got %v", ErrMultipleEdns, err)
+	}
+}
+
+func TestInvalidEdnsOptions(t *testing.T) {
+	opt := ednsToRecord(types.Edns{UdpPayloadSize: 1232})
+	opt.Data = &types.UnknownRData{
+		RecordType: types.RecordTypeOPT,
+		Bytes:      []byte{0x00, 0x0A, 0x00, 0x08, 0x01},
+	}
+
+	_, err := ednsFromRecord(opt)
+	if err != ErrInvalidEdns {
+		t.Fatalf("expected %v, got %v", ErrInvalidEdns, err)
+	}
+}
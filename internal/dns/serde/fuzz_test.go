@@ -0,0 +1,132 @@
+package serde
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/io"
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+	"github.com/SergeyCherepiuk/dns-go/internal/utils"
+)
+
+// The seed corpus in testdata/fuzz mirrors the packets seen on the wire:
+// queries sent by dig and the answers, referrals and negative responses of
+// real name servers. Crashers found by the fuzzer are added there as well.
+
+func FuzzUnmarshalPacket(f *testing.F) {
+	f.Fuzz(func(t *testing.T, bytes []byte) {
+		packet, err := UnmarshalPacket(bytes)
+		if err != nil {
+			return
+		}
+
+		_ = packet.String()
+	})
+}
+
+// FuzzRoundTrip checks that any packet that can be decoded is encoded into
+// the bytes that decode to the same packet. The names are compressed
+// case-insensitively, so a name pointing to an earlier one takes its case,
+// which is why the ASCII case of the names is ignored and the encoding has
+// to stay the same after another round trip.
+func FuzzRoundTrip(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet, err := UnmarshalPacket(data)
+		if err != nil {
+			return
+		}
+
+		encoded, err := MarshalPacket(packet, types.MaxTcpPacketSize)
+		if errors.Is(err, io.ErrTooManyBytes) {
+			// The names compressed differently may take more space.
+			return
+		}
+		if err != nil {
+			t.Fatalf("failed to encode decoded packet: %v\n%s", err, packet.String())
+		}
+
+		decoded, err := UnmarshalPacket(encoded)
+		if err != nil {
+			t.Fatalf("failed to decode encoded packet: %v\n%s", err, packet.String())
+		}
+
+		if !reflect.DeepEqual(foldNames(decoded), foldNames(packet)) {
+			t.Fatalf("packet changed after round trip:%s", utils.Diff(decoded, packet))
+		}
+
+		reencoded, err := MarshalPacket(decoded, types.MaxTcpPacketSize)
+		if err != nil {
+			t.Fatalf("failed to encode decoded packet: %v\n%s", err, decoded.String())
+		}
+
+		if !bytes.Equal(reencoded, encoded) {
+			t.Fatalf("encoding changed after round trip:\n%v\n%v", encoded, reencoded)
+		}
+	})
+}
+
+// foldNames returns the copy of the packet with the ASCII letters of all
+// the names lowercased, everything else is left as is.
+func foldNames(packet types.Packet) types.Packet {
+	packet.Questions = slices.Clone(packet.Questions)
+	for i := range packet.Questions {
+		packet.Questions[i].Domain = foldAscii(packet.Questions[i].Domain)
+	}
+
+	sections := []*[]types.Record{
+		&packet.Records.Answers,
+		&packet.Records.AuthorityRecords,
+		&packet.Records.AdditionalRecords,
+	}
+
+	for _, section := range sections {
+		records := slices.Clone(*section)
+		for i := range records {
+			records[i].Domain = foldAscii(records[i].Domain)
+			records[i].Data = foldRDataNames(records[i].Data)
+		}
+		*section = records
+	}
+
+	return packet
+}
+
+func foldRDataNames(data types.RData) types.RData {
+	switch d := data.(type) {
+	case *types.NSRData:
+		folded := *d
+		folded.Host = foldAscii(d.Host)
+		return &folded
+	case *types.CNAMERData:
+		folded := *d
+		folded.Target = foldAscii(d.Target)
+		return &folded
+	case *types.SOARData:
+		folded := *d
+		folded.MName = foldAscii(d.MName)
+		folded.RName = foldAscii(d.RName)
+		return &folded
+	case *types.PTRRData:
+		folded := *d
+		folded.Host = foldAscii(d.Host)
+		return &folded
+	case *types.MXRData:
+		folded := *d
+		folded.Exchange = foldAscii(d.Exchange)
+		return &folded
+	}
+	return data
+}
+
+func foldAscii(name string) string {
+	folded := []byte(name)
+	for i, c := range folded {
+		if 'A' <= c && c <= 'Z' {
+			folded[i] = c + 'a' - 'A'
+		}
+	}
+	return string(folded)
+}
@@ -16,7 +16,7 @@ func marshalHeader(w *io.PacketWriter, header types.Header) error {
 		recursionAvailableBit  = uint16(utils.BoolToUint8(header.RecursionAvailable)) << 7
 		authenticDataBit       = uint16(utils.BoolToUint8(header.AuthenticData)) << 5
 		checkingDisabledBit    = uint16(utils.BoolToUint8(header.CheckingDisabled)) << 4
-		responseCodeBits       = uint16(header.ResponseCode)
+		responseCodeBits       = uint16(header.ResponseCode) & 0b00001111
 
 		flags = packetTypeBit | opcodeBits | authoritativeAnswerBit | truncatedBit | recursionDesiredBit |
 			recursionAvailableBit | authenticDataBit | checkingDisabledBit | responseCodeBits
@@ -1,12 +1,36 @@
 package serde
 
 import (
+	"sync"
+
 	"github.com/SergeyCherepiuk/dns-go/internal/dns/io"
 	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
 )
 
-func MarshalPacket(packet types.Packet) ([]byte, error) {
-	writer := io.NewPacketWriter()
+// writers keeps the packet writers along with their compression tables
+// between the calls to MarshalPacketTo.
+var writers = sync.Pool{
+	New: func() any { return io.NewPacketWriter(0) },
+}
+
+func MarshalPacket(packet types.Packet, maxSize int) ([]byte, error) {
+	return MarshalPacketTo(nil, packet, maxSize)
+}
+
+// MarshalPacketTo serializes the packet into the given slice, which is
+// only reallocated if it's too small, and returns the written part of it.
+func MarshalPacketTo(buf []byte, packet types.Packet, maxSize int) ([]byte, error) {
+	writer := writers.Get().(*io.PacketWriter)
+	defer func() {
+		writer.Reset(nil, 0)
+		writers.Put(writer)
+	}()
+
+	writer.Reset(buf, maxSize)
+	return marshalPacket(writer, packet)
+}
+
+func marshalPacket(writer *io.PacketWriter, packet types.Packet) ([]byte, error) {
 	err := marshalHeader(writer, packet.Header)
 	if err != nil {
 		return nil, err
@@ -40,6 +64,13 @@ func MarshalPacket(packet types.Packet) ([]byte, error) {
 		}
 	}
 
+	if packet.Edns != nil {
+		err := marshalRecord(writer, ednsToRecord(*packet.Edns))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return writer.Bytes(), nil
 }
 
@@ -89,6 +120,20 @@ func UnmarshalPacket(bytes []byte) (types.Packet, error) {
 			return types.Packet{}, err
 		}
 
+		if additionalRecord.Type == types.RecordTypeOPT {
+			if packet.Edns != nil {
+				return types.Packet{}, ErrMultipleEdns
+			}
+
+			edns, err := ednsFromRecord(additionalRecord)
+			if err != nil {
+				return types.Packet{}, err
+			}
+
+			packet.Edns = &edns
+			continue
+		}
+
 		packet.Records.AdditionalRecords = append(packet.Records.AdditionalRecords, additionalRecord)
 	}
 
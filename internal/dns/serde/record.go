@@ -1,12 +1,34 @@
 package serde
 
 import (
-	"net"
+	"errors"
 
 	"github.com/SergeyCherepiuk/dns-go/internal/dns/io"
 	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
 )
 
+var ErrRDataTypeMismatch = errors.New("rdata doesn't match record type")
+
+var rdataRegistry = map[types.RecordType]func() types.RData{
+	types.RecordTypeA:     func() types.RData { return new(types.ARData) },
+	types.RecordTypeAAAA:  func() types.RData { return new(types.AAAARData) },
+	types.RecordTypeNS:    func() types.RData { return new(types.NSRData) },
+	types.RecordTypeCNAME: func() types.RData { return new(types.CNAMERData) },
+	types.RecordTypeSOA:   func() types.RData { return new(types.SOARData) },
+	types.RecordTypePTR:   func() types.RData { return new(types.PTRRData) },
+	types.RecordTypeMX:    func() types.RData { return new(types.MXRData) },
+	types.RecordTypeTXT:   func() types.RData { return new(types.TXTRData) },
+	types.RecordTypeSRV:   func() types.RData { return new(types.SRVRData) },
+}
+
+func newRData(recordType types.RecordType) types.RData {
+	newRData, ok := rdataRegistry[recordType]
+	if !ok {
+		return &types.UnknownRData{RecordType: recordType}
+	}
+	return newRData()
+}
+
 func marshalRecord(w *io.PacketWriter, record types.Record) error {
 	err := w.WriteDomain(record.Domain)
 	if err != nil {
@@ -28,30 +50,25 @@ func marshalRecord(w *io.PacketWriter, record types.Record) error {
 		return err
 	}
 
-	switch record.Type {
-	case types.RecordTypeA, types.RecordTypeAAAA:
-		bytes := []byte(record.Data.(net.IP))
-
-		err = w.WriteUint16(uint16(len(bytes)))
-		if err != nil {
-			return err
-		}
+	lengthPos := w.Pos()
+	err = w.WriteUint16(0)
+	if err != nil {
+		return err
+	}
 
-		err = w.WriteBytes(bytes)
-		if err != nil {
-			return err
+	if record.Data != nil {
+		if record.Data.Type() != record.Type {
+			return ErrRDataTypeMismatch
 		}
 
-	case types.RecordTypeNS, types.RecordTypeCNAME:
-		domain := record.Data.(string)
-
-		err = w.WriteDomainWithLength(domain)
+		err = record.Data.Marshal(w)
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	length := w.Pos() - lengthPos - 2
+	return w.SetUint16At(lengthPos, uint16(length))
 }
 
 func unmarshalRecord(r *io.PacketReader) (types.Record, error) {
@@ -87,20 +104,16 @@ func unmarshalRecord(r *io.PacketReader) (types.Record, error) {
 		return types.Record{}, err
 	}
 
-	switch record.Type {
-	case types.RecordTypeA, types.RecordTypeAAAA:
-		ip, err := r.ReadBytes(int(length))
-		if err != nil {
-			return types.Record{}, err
-		}
+	start := r.Pos()
+	record.Data = newRData(record.Type)
 
-		record.Data = net.IP(ip)
+	err = record.Data.Unmarshal(r, int(length))
+	if err != nil {
+		return types.Record{}, err
+	}
 
-	case types.RecordTypeNS, types.RecordTypeCNAME:
-		record.Data, err = r.ReadDomain()
-		if err != nil {
-			return types.Record{}, err
-		}
+	if r.Pos()-start != int(length) {
+		return types.Record{}, types.ErrInvalidRDataLength
 	}
 
 	return record, nil
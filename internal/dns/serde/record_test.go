@@ -0,0 +1,314 @@
+package serde
+
+import (
+	"net"
+	"testing"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/io"
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	records := []types.Record{
+		{
+			Domain: "example.com.",
+			Type:   types.RecordTypeA,
+			Class:  types.RecordClassIN,
+			Ttl:    300,
+			Data:   &types.ARData{IP: net.IPv4(93, 184, 216, 34)},
+		},
+		{
+			Domain: "example.com.",
+			Type:   types.RecordTypeAAAA,
+			Class:  types.RecordClassIN,
+			Ttl:    300,
+			Data:   &types.AAAARData{IP: net.ParseIP("2606:2800:220:1:248:1893:25c8:1946")},
+		},
+		{
+			Domain: "example.com.",
+			Type:   types.RecordTypeNS,
+			Class:  types.RecordClassIN,
+			Ttl:    86400,
+			Data:   &types.NSRData{Host: "a.iana-servers.net."},
+		},
+		{
+			Domain: "www.example.com.",
+			Type:   types.RecordTypeCNAME,
+			Class:  types.RecordClassIN,
+			Ttl:    60,
+			Data:   &types.CNAMERData{Target: "example.com."},
+		},
+	}
+
+	for _, record := range records {
+		t.Run(record.Type.String(), func(t *testing.T) {
+			actual := roundTripRecord(t, record)
+			if !actual.Equal(record) {
+				t.Fatalf("expected %v, got %v", record, actual)
+			}
+		})
+	}
+}
+
+func TestExtendedRecordRoundTrip(t *testing.T) {
+	records := []types.Record{
+		{
+			Domain: "example.com.",
+			Type:   types.RecordTypeMX,
+			Class:  types.RecordClassIN,
+			Ttl:    3600,
+			Data:   &types.MXRData{Preference: 10, Exchange: "mail.example.com."},
+		},
+		{
+			Domain: "example.com.",
+			Type:   types.RecordTypeSOA,
+			Class:  types.RecordClassIN,
+			Ttl:    3600,
+			Data: &types.SOARData{
+				MName:   "ns.icann.org.",
+				RName:   "noc.dns.icann.org.",
+				Serial:  2024081403,
+				Refresh: 7200,
+				Retry:   3600,
+				Expire:  1209600,
+				Minimum: 3600,
+			},
+		},
+		{
+			Domain: "example.com.",
+			Type:   types.RecordTypeTXT,
+			Class:  types.RecordClassIN,
+			Ttl:    300,
+			Data:   &types.TXTRData{Texts: []string{"v=spf1 -all", "", "\"quoted\""}},
+		},
+		{
+			Domain: "34.216.184.93.in-addr.arpa.",
+			Type:   types.RecordTypePTR,
+			Class:  types.RecordClassIN,
+			Ttl:    300,
+			Data:   &types.PTRRData{Host: "example.com."},
+		},
+		{
+			Domain: "_sip._tcp.example.com.",
+			Type:   types.RecordTypeSRV,
+			Class:  types.RecordClassIN,
+			Ttl:    300,
+			Data:   &types.SRVRData{Priority: 10, Weight: 60, Port: 5060, Target: "sip.example.com."},
+		},
+	}
+
+	for _, record := range records {
+		t.Run(record.Type.String(), func(t *testing.T) {
+			actual := roundTripRecord(t, record)
+			if !actual.Equal(record) {
+				t.Fatalf("expected %v, got %v", record, actual)
+			}
+		})
+	}
+}
+
+func TestRDataCompression(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       types.RData
+		compressed bool
+	}{
+		{"MX", &types.MXRData{Preference: 10, Exchange: "mail.example.com."}, true},
+		{"SOA", &types.SOARData{MName: "ns.example.com.", RName: "admin.example.com."}, true},
+		{"PTR", &types.PTRRData{Host: "www.example.com."}, true},
+		{"SRV", &types.SRVRData{Target: "sip.example.com."}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record := types.Record{
+				Domain: "example.com.",
+				Type:   test.data.Type(),
+				Class:  types.RecordClassIN,
+				Data:   test.data,
+			}
+
+			w := io.NewPacketWriter(types.MaxPacketSize)
+			err := marshalRecord(w, record)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ownerLength := types.DomainLen(record.Domain)
+			rdlength := int(w.Bytes()[ownerLength+8])<<8 | int(w.Bytes()[ownerLength+9])
+
+			compressed := rdlength < test.data.Len()
+			if compressed != test.compressed {
+				t.Fatalf("expected compressed: %t, got rdlength %d for %d bytes", test.compressed, rdlength, test.data.Len())
+			}
+		})
+	}
+}
+
+func TestUnknownRecordRoundTrip(t *testing.T) {
+	records := []types.Record{
+		{
+			Domain: "example.com.",
+			Type:   types.RecordType(65280),
+			Class:  types.RecordClassIN,
+			Ttl:    300,
+			Data: &types.UnknownRData{
+				RecordType: types.RecordType(65280),
+				Bytes:      []byte{0x0A, 0x00, 0xC0, 0x0C, 0xFF},
+			},
+		},
+		{
+			Domain: "example.com.",
+			Type:   types.RecordType(65281),
+			Class:  types.RecordClass(254),
+			Ttl:    0,
+			Data:   &types.UnknownRData{RecordType: types.RecordType(65281)},
+		},
+	}
+
+	for _, record := range records {
+		t.Run(record.Type.String(), func(t *testing.T) {
+			actual := roundTripRecord(t, record)
+			if !actual.Equal(record) {
+				t.Fatalf("expected %v, got %v", record, actual)
+			}
+		})
+	}
+}
+
+func TestUnknownRecordKeepsPacketInSync(t *testing.T) {
+	packet := types.Packet{
+		Header: types.Header{
+			PacketType:        types.PacketTypeResponse,
+			AnswerSectionSize: 2,
+		},
+		Records: types.PacketRecords{
+			Answers: []types.Record{
+				{
+					Domain: "example.com.",
+					Type:   types.RecordType(99),
+					Class:  types.RecordClassIN,
+					Ttl:    60,
+					Data: &types.UnknownRData{
+						RecordType: types.RecordType(99),
+						Bytes:      []byte("\x0bv=spf1 -all"),
+					},
+				},
+				{
+					Domain: "example.com.",
+					Type:   types.RecordTypeA,
+					Class:  types.RecordClassIN,
+					Ttl:    60,
+					Data:   &types.ARData{IP: net.IPv4(192, 0, 2, 1)},
+				},
+			},
+		},
+	}
+
+	bytes, err := MarshalPacket(packet, types.MaxPacketSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := UnmarshalPacket(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(actual.Records.Answers) != len(packet.Records.Answers) {
+		t.Fatalf("expected %d answers, got %d", len(packet.Records.Answers), len(actual.Records.Answers))
+	}
+
+	for i, answer := range packet.Records.Answers {
+		if !actual.Records.Answers[i].Equal(answer) {
+			t.Fatalf("expected %v, got %v", answer, actual.Records.Answers[i])
+		}
+	}
+
+	reencoded, err := MarshalPacket(actual, types.MaxPacketSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(reencoded) != string(bytes) {
+		t.Fatal("packet changed after a round trip")
+	}
+}
+
+func TestRecordTypeMismatch(t *testing.T) {
+	record := types.Record{
+		Domain: "example.com.",
+		Type:   types.RecordTypeAAAA,
+		Class:  types.RecordClassIN,
+		Data:   &types.ARData{IP: net.IPv4(127, 0, 0, 1)},
+	}
+
+	w := io.NewPacketWriter(types.MaxPacketSize)
+	err := marshalRecord(w, record)
+	if err != ErrRDataTypeMismatch {
+		t.Fatalf("expected %v, got %v", ErrRDataTypeMismatch, err)
+	}
+}
+
+func TestRecordInvalidLength(t *testing.T) {
+	bytes := make([]byte, types.HeaderSize)
+	bytes = append(bytes,
+		0x00,       // root domain
+		0x00, 0x01, // A
+		0x00, 0x01, // IN
+		0x00, 0x00, 0x00, 0x3C, // TTL
+		0x00, 0x03, // RDLENGTH
+		0x7F, 0x00, 0x00,
+	)
+
+	r, err := io.NewPacketReader(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = r.ReadBytes(types.HeaderSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = unmarshalRecord(r)
+	if err != types.ErrInvalidRDataLength {
+		t.Fatalf("expected %v, got %v", types.ErrInvalidRDataLength, err)
+	}
+}
+
+func roundTripRecord(t *testing.T, record types.Record) types.Record {
+	t.Helper()
+
+	w := io.NewPacketWriter(types.MaxPacketSize)
+	err := w.WriteBytes(make([]byte, types.HeaderSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = marshalRecord(w, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := io.NewPacketReader(w.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = r.ReadBytes(types.HeaderSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := unmarshalRecord(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Pos() != len(w.Bytes()) {
+		t.Fatalf("%d unread bytes", len(w.Bytes())-r.Pos())
+	}
+
+	return actual
+}
@@ -0,0 +1,128 @@
+package serde
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/io"
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+)
+
+// MarshalTruncated serializes the packet into the given slice like
+// MarshalPacketTo, except that the packet exceeding maxSize is cut down
+// rather than rejected (RFC 2181, section 9). The RRsets are dropped from
+// the end of the additional section first. If the answer and authority
+// sections still don't fit, the packet is marked as truncated and cut
+// after the last RRset that fits, so the client can retry over TCP. RRsets
+// are never split and the OPT record is always kept.
+func MarshalTruncated(buf []byte, packet types.Packet, maxSize int) ([]byte, error) {
+	bytes, err := MarshalPacketTo(buf, packet, maxSize)
+	if !errors.Is(err, io.ErrTooManyBytes) {
+		return bytes, err
+	}
+
+	packet, err = truncatePacket(packet, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return MarshalPacketTo(buf, packet, maxSize)
+}
+
+// truncatePacket writes the records one RRset at a time to find out how
+// many of them fit along with the OPT record, and drops the rest.
+func truncatePacket(packet types.Packet, maxSize int) (types.Packet, error) {
+	reserved := 0
+	if packet.Edns != nil {
+		writer := io.NewPacketWriter(maxSize)
+		err := marshalRecord(writer, ednsToRecord(*packet.Edns))
+		if err != nil {
+			return types.Packet{}, err
+		}
+		reserved = writer.Pos()
+	}
+
+	writer := io.NewPacketWriter(maxSize - reserved)
+	err := marshalHeader(writer, packet.Header)
+	if err != nil {
+		return types.Packet{}, err
+	}
+
+	for _, question := range packet.Questions {
+		err := marshalQuestion(writer, question)
+		if err != nil {
+			return types.Packet{}, err
+		}
+	}
+
+	sections := []*[]types.Record{
+		&packet.Records.Answers,
+		&packet.Records.AuthorityRecords,
+		&packet.Records.AdditionalRecords,
+	}
+
+	for i, section := range sections {
+		n, err := fittingRecords(writer, *section)
+		if err != nil {
+			return types.Packet{}, err
+		}
+
+		if n == len(*section) {
+			continue
+		}
+
+		*section = (*section)[:n]
+		for _, next := range sections[i+1:] {
+			*next = nil
+		}
+
+		// Leaving out some of the additional records is fine, while the
+		// answer and authority sections are only complete as a whole.
+		if section != &packet.Records.AdditionalRecords {
+			packet.Header.Truncated = true
+		}
+		break
+	}
+
+	packet.UpdateSectionSizes()
+	return packet, nil
+}
+
+// fittingRecords returns the number of the records which fit into the
+// writer without splitting an RRset.
+func fittingRecords(w *io.PacketWriter, records []types.Record) (int, error) {
+	for start := 0; start < len(records); {
+		end := rrsetEnd(records, start)
+
+		for _, record := range records[start:end] {
+			err := marshalRecord(w, record)
+			if errors.Is(err, io.ErrTooManyBytes) {
+				return start, nil
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		start = end
+	}
+
+	return len(records), nil
+}
+
+// rrsetEnd returns the index following the last record of the RRset
+// starting at the given index, the records of an RRset are expected to be
+// next to each other.
+func rrsetEnd(records []types.Record, start int) int {
+	first := records[start]
+
+	end := start + 1
+	for end < len(records) {
+		record := records[end]
+		if record.Type != first.Type || record.Class != first.Class || !strings.EqualFold(record.Domain, first.Domain) {
+			break
+		}
+		end += 1
+	}
+	return end
+}
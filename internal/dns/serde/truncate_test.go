@@ -0,0 +1,141 @@
+package serde
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/io"
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+)
+
+func addressRRset(domain string, size int) []types.Record {
+	records := make([]types.Record, 0, size)
+	for i := range size {
+		records = append(records, types.Record{
+			Domain: domain,
+			Type:   types.RecordTypeA,
+			Class:  types.RecordClassIN,
+			Ttl:    300,
+			Data:   &types.ARData{IP: net.IPv4(192, 0, 2, byte(i))},
+		})
+	}
+	return records
+}
+
+func TestMarshalTruncated(t *testing.T) {
+	cname := types.Record{
+		Domain: "www.example.com.",
+		Type:   types.RecordTypeCNAME,
+		Class:  types.RecordClassIN,
+		Ttl:    300,
+		Data:   &types.CNAMERData{Target: "web.example.com."},
+	}
+
+	// Each of the address records takes 16 bytes, since its owner name is
+	// compressed.
+	tests := []struct {
+		name               string
+		records            types.PacketRecords
+		expectedTruncated  bool
+		expectedAnswers    int
+		expectedAuthority  int
+		expectedAdditional int
+	}{
+		{
+			name: "packet fits",
+			records: types.PacketRecords{
+				Answers:           addressRRset("www.example.com.", 4),
+				AdditionalRecords: addressRRset("ns.example.com.", 4),
+			},
+			expectedAnswers:    4,
+			expectedAdditional: 4,
+		},
+		{
+			name: "additional RRset dropped",
+			records: types.PacketRecords{
+				Answers:           addressRRset("www.example.com.", 4),
+				AuthorityRecords:  addressRRset("example.com.", 4),
+				AdditionalRecords: append(addressRRset("ns1.example.com.", 20), addressRRset("ns2.example.com.", 20)...),
+			},
+			expectedAnswers:    4,
+			expectedAuthority:  4,
+			expectedAdditional: 20,
+		},
+		{
+			name: "authority cut",
+			records: types.PacketRecords{
+				Answers:           addressRRset("www.example.com.", 4),
+				AuthorityRecords:  append(addressRRset("example.com.", 10), addressRRset("example.net.", 20)...),
+				AdditionalRecords: addressRRset("ns.example.com.", 4),
+			},
+			expectedTruncated: true,
+			expectedAnswers:   4,
+			expectedAuthority: 10,
+		},
+		{
+			name: "answer cut",
+			records: types.PacketRecords{
+				Answers:           append([]types.Record{cname}, addressRRset("web.example.com.", 40)...),
+				AdditionalRecords: addressRRset("ns.example.com.", 4),
+			},
+			expectedTruncated: true,
+			expectedAnswers:   1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := types.Packet{
+				Header:    types.Header{ID: 1, PacketType: types.PacketTypeResponse},
+				Questions: []types.Question{{Domain: "www.example.com.", Type: types.QuestionTypeA, Class: types.QuestionClassIN}},
+				Records:   test.records,
+				Edns:      &types.Edns{UdpPayloadSize: types.DefaultEdnsPayloadSize},
+			}
+			packet.UpdateSectionSizes()
+
+			bytes, err := MarshalTruncated(nil, packet, types.MaxPacketSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(bytes) > types.MaxPacketSize {
+				t.Fatalf("packet of %d bytes exceeds the limit", len(bytes))
+			}
+
+			actual, err := UnmarshalPacket(bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if actual.Header.Truncated != test.expectedTruncated {
+				t.Fatalf("expected truncated to be %t", test.expectedTruncated)
+			}
+
+			expected := fmt.Sprint(test.expectedAnswers, test.expectedAuthority, test.expectedAdditional)
+			sizes := fmt.Sprint(len(actual.Records.Answers), len(actual.Records.AuthorityRecords), len(actual.Records.AdditionalRecords))
+			if sizes != expected {
+				t.Fatalf("expected section sizes %s, got %s", expected, sizes)
+			}
+
+			if actual.Edns == nil {
+				t.Fatal("OPT record was dropped")
+			}
+		})
+	}
+}
+
+func TestMarshalTruncatedTooSmall(t *testing.T) {
+	packet := types.Packet{
+		Header:    types.Header{ID: 1, PacketType: types.PacketTypeResponse},
+		Questions: []types.Question{{Domain: "www.example.com.", Type: types.QuestionTypeA, Class: types.QuestionClassIN}},
+		Records:   types.PacketRecords{Answers: addressRRset("www.example.com.", 4)},
+	}
+	packet.UpdateSectionSizes()
+
+	_, err := MarshalTruncated(nil, packet, types.HeaderSize+10)
+	if !errors.Is(err, io.ErrTooManyBytes) {
+		t.Fatalf("expected %v, got %v", io.ErrTooManyBytes, err)
+	}
+}
@@ -1,58 +1,698 @@
 package dns
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"log"
 	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/SergeyCherepiuk/dns-go/internal/dns/cache"
 	"github.com/SergeyCherepiuk/dns-go/internal/dns/serde"
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+	"github.com/SergeyCherepiuk/dns-go/internal/utils"
 )
 
-func StartServer(ctx context.Context, addr net.UDPAddr) error {
-	cache := cache.NewDnsCache(ctx)
+const (
+	DefaultMaxInFlight        = 256
+	DefaultMaxTcpConnections  = 128
+	DefaultTcpIdleTimeout     = 10 * time.Second
+	DefaultQueryTimeout       = 10 * time.Second
+	DefaultStaleAnswerTimeout = 1800 * time.Millisecond
+)
 
-	for {
-		conn, err := net.ListenUDP("udp", &addr)
-		if err != nil {
-			return err
+var ErrNoListeners = errors.New("none of the addresses can be listened on")
+
+type ServerConfig struct {
+	// Upper bound on the number of queries processed concurrently,
+	// DefaultMaxInFlight is used if the value is not positive.
+	MaxInFlight int
+
+	// Upper bound on the number of open TCP connections,
+	// DefaultMaxTcpConnections is used if the value is not positive.
+	MaxTcpConnections int
+
+	// Time a TCP connection is kept open without receiving a query, and the
+	// time given to the client to take a response before the connection is
+	// closed. DefaultTcpIdleTimeout is used if the value is not positive.
+	TcpIdleTimeout time.Duration
+
+	// Overall time given to resolve a single query, including all the
+	// upstream queries. DefaultQueryTimeout is used if the value is not positive.
+	QueryTimeout time.Duration
+
+	// Time after which the client gets a stale answer from the cache if the
+	// resolution hasn't finished yet, the resolution continues in the
+	// background and refreshes the cache (RFC 8767, section 5) if one of the
+	// MaxInFlight slots is free for it.
+	// DefaultStaleAnswerTimeout is used if the value is not positive.
+	StaleAnswerTimeout time.Duration
+
+	// Address families used to reach the name servers, both are allowed
+	// with IPv4 preferred by default.
+	AddressPolicy AddressPolicy
+
+	// Print every query and response. Formatting the whole packets is far
+	// more expensive than answering from the cache, so it's off by default.
+	LogPackets bool
+
+	Cache cache.Config
+
+	// File the cache is loaded from on startup and saved to on shutdown,
+	// the cache isn't persisted if the path is empty.
+	CacheSnapshotPath string
+
+	// Interval between the periodic snapshots of the cache, which are only
+	// taken on shutdown if the value is not positive.
+	CacheSnapshotInterval time.Duration
+}
+
+func (c ServerConfig) withDefaults() ServerConfig {
+	if c.MaxInFlight <= 0 {
+		c.MaxInFlight = DefaultMaxInFlight
+	}
+	if c.MaxTcpConnections <= 0 {
+		c.MaxTcpConnections = DefaultMaxTcpConnections
+	}
+	if c.TcpIdleTimeout <= 0 {
+		c.TcpIdleTimeout = DefaultTcpIdleTimeout
+	}
+	if c.QueryTimeout <= 0 {
+		c.QueryTimeout = DefaultQueryTimeout
+	}
+	if c.StaleAnswerTimeout <= 0 {
+		c.StaleAnswerTimeout = DefaultStaleAnswerTimeout
+	}
+	return c
+}
+
+type server struct {
+	// Context of the server as a whole, the background work started on
+	// behalf of a query (e.g. refreshing the cache after a stale answer)
+	// outlives the query's own context.
+	ctx      context.Context
+	config   ServerConfig
+	cache    *cache.DnsCache
+	flights  *flightGroup
+	inFlight chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newServer(ctx context.Context, config ServerConfig) *server {
+	config = config.withDefaults()
+	s := &server{
+		ctx:      ctx,
+		config:   config,
+		cache:    cache.NewDnsCache(ctx, config.Cache),
+		flights:  newFlightGroup(),
+		inFlight: make(chan struct{}, config.MaxInFlight),
+	}
+
+	if config.CacheSnapshotPath != "" {
+		err := s.cache.LoadSnapshot(config.CacheSnapshotPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("failed to load cache snapshot: %v", err)
 		}
+	}
+
+	return s
+}
 
-		err = handleConnection(conn, cache)
+// StartServer listens for queries on both UDP and TCP on each of the given
+// addresses and blocks until the context is cancelled or one of the
+// listeners fails. IPv6 addresses only accept IPv6 clients, so the same port
+// can be used for both IPv4 and IPv6. The addresses of the family the host
+// doesn't support (e.g. IPv6 disabled in a container) are skipped.
+func StartServer(ctx context.Context, addrs []net.UDPAddr, config ServerConfig) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		udpConns     = make([]*net.UDPConn, 0, len(addrs))
+		tcpListeners = make([]*net.TCPListener, 0, len(addrs))
+	)
+
+	for _, addr := range addrs {
+		udpConn, tcpListener, err := listen(addr)
+		if isUnsupportedAddress(addr, err) {
+			log.Printf("skipping %s: %v", addr.String(), err)
+			continue
+		}
 		if err != nil {
+			for i := range udpConns {
+				udpConns[i].Close()
+				tcpListeners[i].Close()
+			}
 			return err
 		}
+
+		udpConns = append(udpConns, udpConn)
+		tcpListeners = append(tcpListeners, tcpListener)
+	}
+
+	if len(udpConns) == 0 {
+		return ErrNoListeners
+	}
+
+	s := newServer(ctx, config)
+	defer s.wg.Wait()
+
+	errs := make(chan error, 2*len(udpConns))
+	for i := range udpConns {
+		go func() { errs <- s.serveUdp(ctx, udpConns[i]) }()
+		go func() { errs <- s.serveTcp(ctx, tcpListeners[i]) }()
 	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.prefetch(ctx)
+	}()
+
+	if config.CacheSnapshotPath != "" {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.persistCache(ctx)
+		}()
+	}
+
+	err := <-errs
+	cancel()
+	for range 2*len(udpConns) - 1 {
+		<-errs
+	}
+	return err
 }
 
-func handleConnection(conn *net.UDPConn, cache *cache.DnsCache) error {
-	defer conn.Close()
+// isUnsupportedAddress reports whether the address can't be listened on
+// because the host doesn't support or hasn't configured its family. An
+// address that is merely missing from the host (e.g. a mistyped one) isn't
+// skipped.
+func isUnsupportedAddress(addr net.UDPAddr, err error) bool {
+	if errors.Is(err, syscall.EAFNOSUPPORT) || errors.Is(err, syscall.EPROTONOSUPPORT) {
+		return true
+	}
+	return errors.Is(err, syscall.EADDRNOTAVAIL) && !hasLoopback(addr.IP)
+}
 
-	buf := make([]byte, 512)
-	n, addr, err := conn.ReadFromUDP(buf)
-	if err != nil {
-		return err
+// hasLoopback reports whether the loopback address of the IP's family can
+// be listened on, which it can on any host with the family configured.
+func hasLoopback(ip net.IP) bool {
+	network, loopback := "udp6", net.IPv6loopback
+	if ip.To4() != nil {
+		network, loopback = "udp4", net.IPv4(127, 0, 0, 1)
 	}
 
-	query, err := serde.UnmarshalPacket(buf[:n])
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: loopback})
 	if err != nil {
-		return err
+		return false
 	}
+	conn.Close()
+	return true
+}
 
-	fmt.Println(query.String())
+// listen binds the address to the network of its own family, since the
+// wildcard IPv4 address would otherwise get a dual-stack socket, which takes
+// the port of the wildcard IPv6 address as well.
+func listen(addr net.UDPAddr) (*net.UDPConn, *net.TCPListener, error) {
+	udpNetwork, tcpNetwork := "udp", "tcp"
+	switch {
+	case addr.IP == nil:
+	case addr.IP.To4() != nil:
+		udpNetwork, tcpNetwork = "udp4", "tcp4"
+	default:
+		udpNetwork, tcpNetwork = "udp6", "tcp6"
+	}
 
-	response, err := Lookup(query, cache)
+	udpConn, err := net.ListenUDP(udpNetwork, &addr)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	fmt.Println(response.String())
+	tcpAddr := net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
+	tcpListener, err := net.ListenTCP(tcpNetwork, &tcpAddr)
+	if err != nil {
+		udpConn.Close()
+		return nil, nil, err
+	}
+
+	return udpConn, tcpListener, nil
+}
 
-	responseBytes, err := serde.MarshalPacket(response)
+// persistCache saves the cache periodically and once more when the context
+// is cancelled, so the next start doesn't begin with the empty cache.
+func (s *server) persistCache(ctx context.Context) {
+	var tick <-chan time.Time
+	if s.config.CacheSnapshotInterval > 0 {
+		ticker := time.NewTicker(s.config.CacheSnapshotInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+		case <-ctx.Done():
+			s.saveCache()
+			return
+		}
+
+		s.saveCache()
+	}
+}
+
+func (s *server) saveCache() {
+	err := s.cache.SaveSnapshot(s.config.CacheSnapshotPath)
 	if err != nil {
-		return err
+		log.Printf("failed to save cache snapshot: %v", err)
+	}
+}
+
+// prefetch resolves again the popular RRsets the cache reports to be about
+// to expire. The prefetches share the limit with the clients' queries and
+// are skipped while the server is busy.
+func (s *server) prefetch(ctx context.Context) {
+	for {
+		var key cache.RRsetKey
+		select {
+		case key = <-s.cache.Prefetches():
+		case <-ctx.Done():
+			return
+		}
+
+		if key.Class != types.RecordClassIN || !s.tryAcquire() {
+			continue
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.release()
+
+			ctx, cancel := context.WithTimeout(ctx, s.config.QueryTimeout)
+			defer cancel()
+
+			query := constructQuery(key.Domain, types.QuestionType(key.Type))
+			_, err := lookupUpstream(ctx, query, s.cache, s.config.AddressPolicy, newResolution(s.flights))
+			if err != nil {
+				log.Printf("failed to prefetch %s: %v", key.Domain, err)
+			}
+		}()
+	}
+}
+
+func (s *server) serveUdp(ctx context.Context, conn *net.UDPConn) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	for {
+		buf := getBuffer()
+		n, clientAddr, err := conn.ReadFromUDP(*buf)
+		if err != nil {
+			putBuffer(buf)
+			return listenerError(ctx, err)
+		}
+
+		if !s.acquire(ctx) {
+			putBuffer(buf)
+			return ctx.Err()
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.release()
+			defer putBuffer(buf)
+
+			responseBuf := getBuffer()
+			defer putBuffer(responseBuf)
+
+			responseBytes, ok := s.handleQuery(ctx, (*buf)[:n], "udp", *responseBuf)
+			if !ok {
+				return
+			}
+
+			_, err := conn.WriteToUDP(responseBytes, clientAddr)
+			if err != nil {
+				log.Printf("failed to send response to %s: %v", clientAddr, err)
+			}
+		}()
 	}
+}
+
+func (s *server) serveTcp(ctx context.Context, listener *net.TCPListener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	connections := make(chan struct{}, s.config.MaxTcpConnections)
+
+	for {
+		select {
+		case connections <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			return listenerError(ctx, err)
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() { <-connections }()
+
+			s.handleTcpConnection(ctx, conn)
+		}()
+	}
+}
+
+// handleTcpConnection reads length-prefixed queries until the client closes
+// the connection or stays idle for too long. Queries are processed
+// concurrently, so responses may be sent in a different order (RFC 7766).
+func (s *server) handleTcpConnection(ctx context.Context, conn *net.TCPConn) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	var (
+		reader  = bufio.NewReader(conn)
+		writeMu sync.Mutex
+		wg      sync.WaitGroup
+	)
 
-	_, err = conn.WriteToUDP(responseBytes, addr)
+	// The queries already read are answered even if the client has stopped
+	// sending new ones (e.g. half-closed the connection), the write deadline
+	// keeps a client that doesn't read from holding their slots.
+	defer func() {
+		wg.Wait()
+		cancel()
+	}()
+
+	for {
+		err := conn.SetReadDeadline(time.Now().Add(s.config.TcpIdleTimeout))
+		if err != nil {
+			return
+		}
+
+		buf := getBuffer()
+		queryBytes, err := readTcpMessage(reader, *buf)
+		if err != nil {
+			putBuffer(buf)
+			return
+		}
+
+		if !s.acquire(ctx) {
+			putBuffer(buf)
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.release()
+			defer putBuffer(buf)
+
+			responseBuf := getBuffer()
+			defer putBuffer(responseBuf)
+
+			responseBytes, ok := s.handleQuery(ctx, queryBytes, "tcp", *responseBuf)
+			if !ok {
+				return
+			}
+
+			writeMu.Lock()
+			defer writeMu.Unlock()
+
+			err := conn.SetWriteDeadline(time.Now().Add(s.config.TcpIdleTimeout))
+			if err == nil {
+				err = writeTcpMessage(conn, responseBytes)
+			}
+			if err != nil {
+				log.Printf("failed to send response to %s: %v", conn.RemoteAddr(), err)
+				cancel()
+			}
+		}()
+	}
+}
+
+func (s *server) acquire(ctx context.Context) bool {
+	select {
+	case s.inFlight <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *server) tryAcquire() bool {
+	select {
+	case s.inFlight <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *server) release() {
+	<-s.inFlight
+}
+
+func listenerError(ctx context.Context, err error) error {
+	if ctx.Err() != nil && errors.Is(err, net.ErrClosed) {
+		return ctx.Err()
+	}
 	return err
 }
+
+// handleQuery never fails, any error is logged and turned into an error
+// response to the client. The second return value is false if the packet
+// should be left without a reply. Network is either "udp" or "tcp". The
+// response is written into buf, unless it doesn't fit.
+func (s *server) handleQuery(ctx context.Context, queryBytes []byte, network string, buf []byte) (responseBytes []byte, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic while handling query: %v", r)
+			responseBytes, ok = rawErrorResponse(queryBytes, types.ResponseCodeServerFailure)
+		}
+	}()
+
+	query, err := serde.UnmarshalPacket(queryBytes)
+	if err != nil {
+		log.Printf("failed to parse query: %v", err)
+		return rawErrorResponse(queryBytes, types.ResponseCodeFormatError)
+	}
+
+	if query.Header.PacketType != types.PacketTypeQuery {
+		return nil, false
+	}
+
+	if s.config.LogPackets {
+		fmt.Println(query.String())
+	}
+
+	maxSize := responseSizeLimit(query, network)
+
+	if query.Edns != nil && query.Edns.Version > types.EdnsVersion {
+		response := constructErrorResponse(query, types.ResponseCodeNoError)
+		response.Edns.ExtendedResponseCode = types.ExtendedResponseCodeBadVersion
+		return marshalResponse(query, response, maxSize, buf)
+	}
+
+	if query.Header.Opcode != types.OpcodeQuery {
+		response := constructErrorResponse(query, types.ResponseCodeNotImplemented)
+		return marshalResponse(query, response, maxSize, buf)
+	}
+
+	if len(query.Questions) != 1 {
+		response := constructErrorResponse(query, types.ResponseCodeFormatError)
+		return marshalResponse(query, response, maxSize, buf)
+	}
+
+	response, err := s.resolve(ctx, query)
+	if err != nil {
+		log.Printf("failed to resolve %s: %v", query.Questions[0].Domain, err)
+		response = constructErrorResponse(query, types.ResponseCodeServerFailure)
+	}
+
+	response.Edns = responseEdns(query)
+
+	if s.config.LogPackets {
+		fmt.Println(response.String())
+	}
+
+	return marshalResponse(query, response, maxSize, buf)
+}
+
+// resolve looks the query up, falling back to the stale answer from the
+// cache if the lookup fails or takes longer than StaleAnswerTimeout. In the
+// latter case the lookup isn't cancelled, so it refreshes the cache.
+func (s *server) resolve(ctx context.Context, query types.Packet) (types.Packet, error) {
+	// Answers from the cache don't need the timers of the full lookup.
+	response, _, complete := cachedResponse(s.cache, query)
+	if complete {
+		return response, nil
+	}
+
+	results := make(chan lookupResult, 1)
+
+	// The lookup is only tied to the query's context until a stale answer
+	// is served, after that it keeps running to refresh the cache.
+	lookupCtx, cancel := context.WithTimeout(s.ctx, s.config.QueryTimeout)
+	stop := context.AfterFunc(ctx, cancel)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+		defer stop()
+
+		response, err := lookupQuery(lookupCtx, query, s.cache, s.config.AddressPolicy, s.flights)
+		results <- lookupResult{response, err}
+	}()
+
+	timer := time.NewTimer(s.config.StaleAnswerTimeout)
+	defer timer.Stop()
+
+	var r lookupResult
+	select {
+	case r = <-results:
+	case <-timer.C:
+		stale, ok := staleResponse(s.cache, query)
+		if ok {
+			s.refresh(results, stop, cancel)
+			return stale, nil
+		}
+		r = <-results
+	}
+
+	if r.err != nil {
+		stale, ok := staleResponse(s.cache, query)
+		if ok {
+			log.Printf("serving stale answer for %s: %v", query.Questions[0].Domain, r.err)
+			return stale, nil
+		}
+	}
+	return r.response, r.err
+}
+
+type lookupResult struct {
+	response types.Packet
+	err      error
+}
+
+// refresh lets the lookup, which outlived the stale answer, finish in the
+// background. It takes a slot of its own, since the query's slot is released
+// along with the response, and the lookup is cancelled if there is none.
+// Nothing is left to refresh if the lookup has already finished or been
+// cancelled along with the query.
+func (s *server) refresh(results <-chan lookupResult, stop func() bool, cancel context.CancelFunc) {
+	if !stop() || !s.tryAcquire() {
+		cancel()
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.release()
+		<-results
+	}()
+}
+
+// responseSizeLimit returns the maximum size of the response: UDP responses
+// are limited by the buffer size advertised by the client (RFC 6891, section
+// 6.2.5), which is capped at the size the server is willing to send.
+func responseSizeLimit(query types.Packet, network string) int {
+	if network == "tcp" {
+		return types.MaxTcpPacketSize
+	}
+
+	if query.Edns == nil {
+		return types.MaxPacketSize
+	}
+
+	size := max(int(query.Edns.UdpPayloadSize), types.MaxPacketSize)
+	return min(size, types.DefaultEdnsPayloadSize)
+}
+
+// responseEdns returns the OPT record for the response, which is only
+// included if the client has sent one with the query.
+func responseEdns(query types.Packet) *types.Edns {
+	if query.Edns == nil {
+		return nil
+	}
+
+	return &types.Edns{
+		UdpPayloadSize: types.DefaultEdnsPayloadSize,
+		Version:        types.EdnsVersion,
+		DnssecOk:       query.Edns.DnssecOk,
+	}
+}
+
+// marshalResponse serializes the response, truncating it if it exceeds the
+// size limit, so the client retries over TCP. The server failure is only
+// returned if the response can't be serialized at all.
+func marshalResponse(query, response types.Packet, maxSize int, buf []byte) ([]byte, bool) {
+	response.UpdateSectionSizes()
+
+	responseBytes, err := serde.MarshalTruncated(buf, response, maxSize)
+	if err == nil {
+		return responseBytes, true
+	}
+
+	log.Printf("failed to serialize response: %v", err)
+
+	response = constructErrorResponse(query, types.ResponseCodeServerFailure)
+	response.UpdateSectionSizes()
+
+	responseBytes, err = serde.MarshalPacketTo(buf, response, maxSize)
+	if err != nil {
+		log.Printf("failed to serialize error response: %v", err)
+		return nil, false
+	}
+	return responseBytes, true
+}
+
+// rawErrorResponse is used when the query can't be parsed, so only the
+// fields from the fixed part of the header are echoed back.
+func rawErrorResponse(queryBytes []byte, responseCode types.ResponseCode) ([]byte, bool) {
+	if len(queryBytes) < 3 {
+		return nil, false
+	}
+
+	if queryBytes[2]>>7 == uint8(types.PacketTypeResponse) {
+		return nil, false
+	}
+
+	response := types.Packet{
+		Header: types.Header{
+			ID:                 utils.BytesToUint16([2]byte(queryBytes[0:2])),
+			PacketType:         types.PacketTypeResponse,
+			Opcode:             types.Opcode((queryBytes[2] >> 3) & 0b00001111),
+			RecursionDesired:   queryBytes[2]&0b00000001 == 1,
+			RecursionAvailable: true,
+			ResponseCode:       responseCode,
+		},
+	}
+
+	responseBytes, err := serde.MarshalPacket(response, types.MaxPacketSize)
+	if err != nil {
+		return nil, false
+	}
+	return responseBytes, true
+}
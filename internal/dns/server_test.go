@@ -0,0 +1,504 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/cache"
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/serde"
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+	"github.com/SergeyCherepiuk/dns-go/internal/utils"
+)
+
+func TestHandleQueryErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newServer(ctx, ServerConfig{})
+
+	question := types.Question{
+		Domain: "example.com.",
+		Type:   types.QuestionTypeA,
+		Class:  types.QuestionClassIN,
+	}
+
+	tests := []struct {
+		name     string
+		query    []byte
+		expected types.Header
+	}{
+		{
+			name:  "truncated header",
+			query: []byte{0x12, 0x34, 0x01, 0x00, 0x00},
+			expected: types.Header{
+				ID:                 0x1234,
+				PacketType:         types.PacketTypeResponse,
+				RecursionDesired:   true,
+				RecursionAvailable: true,
+				ResponseCode:       types.ResponseCodeFormatError,
+			},
+		},
+		{
+			name: "missing question",
+			query: mustMarshal(t, types.Packet{
+				Header: types.Header{ID: 1, QuestionSectionSize: 1},
+			}),
+			expected: types.Header{
+				ID:                 1,
+				PacketType:         types.PacketTypeResponse,
+				RecursionAvailable: true,
+				ResponseCode:       types.ResponseCodeFormatError,
+			},
+		},
+		{
+			name: "no questions",
+			query: mustMarshal(t, types.Packet{
+				Header: types.Header{ID: 2},
+			}),
+			expected: types.Header{
+				ID:                 2,
+				PacketType:         types.PacketTypeResponse,
+				RecursionAvailable: true,
+				ResponseCode:       types.ResponseCodeFormatError,
+			},
+		},
+		{
+			name: "inverse query",
+			query: mustMarshal(t, types.Packet{
+				Header: types.Header{
+					ID:                  3,
+					Opcode:              types.OpcodeIQuery,
+					QuestionSectionSize: 1,
+				},
+				Questions: []types.Question{question},
+			}),
+			expected: types.Header{
+				ID:                  3,
+				PacketType:          types.PacketTypeResponse,
+				Opcode:              types.OpcodeIQuery,
+				RecursionAvailable:  true,
+				ResponseCode:        types.ResponseCodeNotImplemented,
+				QuestionSectionSize: 1,
+			},
+		},
+		{
+			name: "status",
+			query: mustMarshal(t, types.Packet{
+				Header: types.Header{
+					ID:                  4,
+					Opcode:              types.OpcodeStatus,
+					RecursionDesired:    true,
+					QuestionSectionSize: 1,
+				},
+				Questions: []types.Question{question},
+			}),
+			expected: types.Header{
+				ID:                  4,
+				PacketType:          types.PacketTypeResponse,
+				Opcode:              types.OpcodeStatus,
+				RecursionDesired:    true,
+				RecursionAvailable:  true,
+				ResponseCode:        types.ResponseCodeNotImplemented,
+				QuestionSectionSize: 1,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			responseBytes, ok := s.handleQuery(ctx, test.query, "udp", nil)
+			if !ok {
+				t.Fatal("no response")
+			}
+
+			response, err := serde.UnmarshalPacket(responseBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entries := utils.Diff(response.Header, test.expected)
+			if len(entries) > 0 {
+				t.Fatal(entries.String())
+			}
+		})
+	}
+}
+
+func TestHandleQueryIgnoresResponses(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newServer(ctx, ServerConfig{})
+
+	malformed := []byte{0x12, 0x34, 0x80, 0x00}
+	if _, ok := s.handleQuery(ctx, malformed, "udp", nil); ok {
+		t.Fatal("replied to a malformed response")
+	}
+
+	response := mustMarshal(t, types.Packet{
+		Header: types.Header{ID: 1, PacketType: types.PacketTypeResponse},
+	})
+	if _, ok := s.handleQuery(ctx, response, "udp", nil); ok {
+		t.Fatal("replied to a response")
+	}
+}
+
+func TestHandleQueryEdns(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newServer(ctx, ServerConfig{})
+
+	query := types.Packet{
+		Header: types.Header{ID: 1, Opcode: types.OpcodeStatus},
+		Questions: []types.Question{
+			{Domain: "example.com.", Type: types.QuestionTypeA, Class: types.QuestionClassIN},
+		},
+		Edns: &types.Edns{UdpPayloadSize: 4096, DnssecOk: true},
+	}
+	query.UpdateSectionSizes()
+
+	responseBytes, ok := s.handleQuery(ctx, mustMarshal(t, query), "udp", nil)
+	if !ok {
+		t.Fatal("no response")
+	}
+
+	response, err := serde.UnmarshalPacket(responseBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Edns == nil {
+		t.Fatal("OPT record is missing in the response")
+	}
+
+	expected := types.Edns{UdpPayloadSize: types.DefaultEdnsPayloadSize, DnssecOk: true}
+	entries := utils.Diff(*response.Edns, expected)
+	if len(entries) > 0 {
+		t.Fatal(entries.String())
+	}
+
+	query.Edns.Version = 1
+	responseBytes, ok = s.handleQuery(ctx, mustMarshal(t, query), "udp", nil)
+	if !ok {
+		t.Fatal("no response")
+	}
+
+	response, err = serde.UnmarshalPacket(responseBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Edns == nil || response.Edns.ExtendedResponseCode != types.ExtendedResponseCodeBadVersion {
+		t.Fatalf("expected BADVERS, got %v", response.Edns)
+	}
+}
+
+func TestHandleQueryTruncation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newServer(ctx, ServerConfig{})
+
+	records := make([]types.Record, 0, 64)
+	for i := range 64 {
+		records = append(records, types.Record{
+			Domain: "www.example.com.",
+			Type:   types.RecordTypeA,
+			Class:  types.RecordClassIN,
+			Ttl:    3600,
+			Data:   &types.ARData{IP: net.IPv4(192, 0, 2, byte(i))},
+		})
+	}
+	s.cache.Set(records)
+
+	query := constructQuery("www.example.com.", types.QuestionTypeA)
+	query.UpdateSectionSizes()
+
+	tests := []struct {
+		network           string
+		expectedTruncated bool
+		expectedAnswers   int
+	}{
+		{network: "udp", expectedTruncated: true, expectedAnswers: 0},
+		{network: "tcp", expectedTruncated: false, expectedAnswers: len(records)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.network, func(t *testing.T) {
+			responseBytes, ok := s.handleQuery(ctx, mustMarshal(t, query), test.network, nil)
+			if !ok {
+				t.Fatal("no response")
+			}
+
+			response, err := serde.UnmarshalPacket(responseBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.Header.ResponseCode != types.ResponseCodeNoError {
+				t.Fatalf("expected NOERROR, got %d", response.Header.ResponseCode)
+			}
+
+			if response.Header.Truncated != test.expectedTruncated || len(response.Records.Answers) != test.expectedAnswers {
+				t.Fatalf(
+					"expected (%t, %d answers), got (%t, %d answers)",
+					test.expectedTruncated, test.expectedAnswers,
+					response.Header.Truncated, len(response.Records.Answers),
+				)
+			}
+		})
+	}
+}
+
+func TestResponseSizeLimit(t *testing.T) {
+	withEdns := func(size uint16) types.Packet {
+		return types.Packet{Edns: &types.Edns{UdpPayloadSize: size}}
+	}
+
+	entries := make(utils.DiffEntries, 0)
+
+	entries = append(entries, utils.Diff(responseSizeLimit(types.Packet{}, "udp"), types.MaxPacketSize)...)
+	entries = append(entries, utils.Diff(responseSizeLimit(types.Packet{}, "tcp"), types.MaxTcpPacketSize)...)
+	entries = append(entries, utils.Diff(responseSizeLimit(withEdns(100), "udp"), types.MaxPacketSize)...)
+	entries = append(entries, utils.Diff(responseSizeLimit(withEdns(1000), "udp"), 1000)...)
+	entries = append(entries, utils.Diff(responseSizeLimit(withEdns(4096), "udp"), types.DefaultEdnsPayloadSize)...)
+	entries = append(entries, utils.Diff(responseSizeLimit(withEdns(4096), "tcp"), types.MaxTcpPacketSize)...)
+
+	if len(entries) > 0 {
+		t.Fatal(entries.String())
+	}
+}
+
+func mustMarshal(t testing.TB, packet types.Packet) []byte {
+	t.Helper()
+
+	bytes, err := serde.MarshalPacket(packet, types.MaxPacketSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes
+}
+
+func TestStartServerMissingAddress(t *testing.T) {
+	// 192.0.2.0/24 is reserved for documentation, so it's not assigned to
+	// any interface, which is most likely a mistake rather than something
+	// to skip.
+	missing := net.UDPAddr{IP: net.IPv4(192, 0, 2, 1)}
+	available := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := StartServer(ctx, []net.UDPAddr{missing, available}, ServerConfig{})
+	if !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		t.Fatalf("expected %v, got %v", syscall.EADDRNOTAVAIL, err)
+	}
+}
+
+func TestStartServerDualStack(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// IPv6 is skipped on the hosts without it, otherwise both addresses
+	// have to be listened on the same port.
+	addrs := []net.UDPAddr{
+		{IP: net.IPv4zero, Port: port},
+		{IP: net.IPv6unspecified, Port: port},
+	}
+	err = StartServer(ctx, addrs, ServerConfig{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestResolveStaleRefresh(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	useNameServerPort(t)
+	useRootServers(t, net.IPv4(127, 0, 0, 2))
+	startNameServer(t, net.IPv4(127, 0, 0, 2), silentNameServer)
+
+	s := newServer(ctx, ServerConfig{
+		MaxInFlight:        1,
+		QueryTimeout:       500 * time.Millisecond,
+		StaleAnswerTimeout: 50 * time.Millisecond,
+		AddressPolicy:      IPv4Only,
+		Cache:              cache.Config{MaxTtl: time.Millisecond},
+	})
+
+	for _, domain := range []string{"a.example.com.", "b.example.com."} {
+		s.cache.Set([]types.Record{{Domain: domain, Type: types.RecordTypeA, Class: types.RecordClassIN, Ttl: 300, Data: &types.ARData{IP: net.IPv4(192, 0, 2, 1)}}})
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// The refresh outlives the query it was started for.
+	queryCtx, cancelQuery := context.WithCancel(ctx)
+	response, err := s.resolve(queryCtx, constructQuery("a.example.com.", types.QuestionTypeA))
+	if err != nil || len(response.Records.Answers) != 1 {
+		t.Fatalf("expected stale answer, got %v, %v", response, err)
+	}
+	cancelQuery()
+
+	time.Sleep(50 * time.Millisecond)
+	if len(s.inFlight) != 1 {
+		t.Fatal("refresh doesn't hold a slot")
+	}
+
+	// There is no slot left for another refresh, yet the client still
+	// gets the stale answer.
+	response, err = s.resolve(ctx, constructQuery("b.example.com.", types.QuestionTypeA))
+	if err != nil || len(response.Records.Answers) != 1 {
+		t.Fatalf("expected stale answer, got %v, %v", response, err)
+	}
+
+	if len(s.inFlight) != 1 {
+		t.Fatalf("expected 1 slot taken, got %d", len(s.inFlight))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("refresh wasn't bounded by the query timeout")
+	}
+
+	if len(s.inFlight) != 0 {
+		t.Fatal("refresh didn't release its slot")
+	}
+}
+
+func TestServeUdpMaxInFlight(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const maxInFlight = 3
+
+	// The name server never answers, so each of the handlers stays blocked
+	// until the query times out. The handlers in flight are counted by the
+	// distinct names it has been asked about.
+	var (
+		mu    sync.Mutex
+		asked = make(map[string]bool)
+	)
+	useNameServerPort(t)
+	useRootServers(t, net.IPv4(127, 0, 0, 3))
+	startNameServer(t, net.IPv4(127, 0, 0, 3), func(query types.Packet) (types.Packet, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		asked[query.Questions[0].Domain] = true
+		return types.Packet{}, false
+	})
+	askedCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(asked)
+	}
+
+	s := newServer(ctx, ServerConfig{
+		MaxInFlight:   maxInFlight,
+		QueryTimeout:  300 * time.Millisecond,
+		AddressPolicy: IPv4Only,
+	})
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serveUdp(ctx, conn)
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	const queries = 10
+	for i := range queries {
+		query := constructQuery(fmt.Sprintf("%d.example.com.", i), types.QuestionTypeA)
+		query.Header.RecursionDesired = true
+		_, err := client.Write(mustMarshal(t, query))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if n := askedCount(); n != maxInFlight {
+		t.Fatalf("expected %d queries in flight, got %d", maxInFlight, n)
+	}
+
+	// The rest of the queries are handled as the slots are released.
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, types.MaxPacketSize)
+	for range queries {
+		_, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(s.inFlight) > maxInFlight {
+			t.Fatalf("%d queries in flight", len(s.inFlight))
+		}
+	}
+
+	if n := askedCount(); n != queries {
+		t.Fatalf("expected all %d queries to be handled, got %d", queries, n)
+	}
+}
+
+func TestHandleQueryResponseFlags(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The name server answers authoritatively and without recursion, none
+	// of which should reach the client.
+	useNameServerPort(t)
+	useRootServers(t, net.IPv4(127, 0, 0, 7))
+	startNameServer(t, net.IPv4(127, 0, 0, 7), addressNameServer)
+
+	s := newServer(ctx, ServerConfig{AddressPolicy: IPv4Only})
+
+	query := constructQuery("example.com.", types.QuestionTypeA)
+	query.Header.RecursionDesired = true
+	queryBytes := mustMarshal(t, query)
+
+	for _, path := range []string{"miss", "hit"} {
+		responseBytes, ok := s.handleQuery(ctx, queryBytes, "udp", nil)
+		if !ok {
+			t.Fatalf("%s: no response", path)
+		}
+
+		response, err := serde.UnmarshalPacket(responseBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header := response.Header
+		if header.ID != query.Header.ID || !header.RecursionDesired || !header.RecursionAvailable || header.AuthoritativeAnswer {
+			t.Fatalf("%s: unexpected header %+v", path, header)
+		}
+
+		if header.ResponseCode != types.ResponseCodeNoError || len(response.Records.Answers) != 1 {
+			t.Fatalf("%s: expected an answer, got code %d with %v", path, header.ResponseCode, response.Records.Answers)
+		}
+	}
+}
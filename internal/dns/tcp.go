@@ -0,0 +1,53 @@
+package dns
+
+import (
+	"errors"
+	"io"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+	"github.com/SergeyCherepiuk/dns-go/internal/utils"
+)
+
+var ErrMessageTooLong = errors.New("message too long")
+
+// Messages sent over TCP are prefixed with a two byte length field
+// (RFC 1035, section 4.2.2).
+
+// readTcpMessage reads the message into the given buffer, a new one is
+// allocated only if the message doesn't fit.
+func readTcpMessage(r io.Reader, buf []byte) ([]byte, error) {
+	var lengthBytes [2]byte
+	_, err := io.ReadFull(r, lengthBytes[:])
+	if err != nil {
+		return nil, err
+	}
+
+	length := utils.BytesToUint16(lengthBytes)
+	message := buf[:0]
+	if cap(message) < int(length) {
+		message = make([]byte, length)
+	}
+	message = message[:length]
+
+	_, err = io.ReadFull(r, message)
+	if err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+func writeTcpMessage(w io.Writer, message []byte) error {
+	if len(message) > types.MaxTcpPacketSize {
+		return ErrMessageTooLong
+	}
+
+	lengthBytes := utils.Uint16ToBytes(uint16(len(message)))
+
+	bytes := make([]byte, 0, len(message)+2)
+	bytes = append(bytes, lengthBytes[:]...)
+	bytes = append(bytes, message...)
+
+	_, err := w.Write(bytes)
+	return err
+}
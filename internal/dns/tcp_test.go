@@ -0,0 +1,231 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/serde"
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/types"
+	"github.com/SergeyCherepiuk/dns-go/internal/utils"
+)
+
+func TestTcpMessageFraming(t *testing.T) {
+	var buf bytes.Buffer
+
+	messages := [][]byte{
+		{},
+		{0x01, 0x02, 0x03},
+		bytes.Repeat([]byte{0xAB}, types.MaxTcpPacketSize),
+	}
+
+	for _, message := range messages {
+		err := writeTcpMessage(&buf, message)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, expected := range messages {
+		actual, err := readTcpMessage(&buf, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(actual, expected) {
+			t.Fatalf("message of length %d was altered", len(expected))
+		}
+	}
+
+	err := writeTcpMessage(&buf, make([]byte, types.MaxTcpPacketSize+1))
+	if err != ErrMessageTooLong {
+		t.Fatalf("expected %v, got %v", ErrMessageTooLong, err)
+	}
+}
+
+func TestTcpPipelining(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newServer(ctx, ServerConfig{})
+	go s.serveTcp(ctx, listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	ids := []uint16{1, 2, 3}
+	for _, id := range ids {
+		query := mustMarshal(t, types.Packet{
+			Header: types.Header{
+				ID:                  id,
+				Opcode:              types.OpcodeIQuery,
+				QuestionSectionSize: 1,
+			},
+			Questions: []types.Question{
+				{Domain: "example.com.", Type: types.QuestionTypeA, Class: types.QuestionClassIN},
+			},
+		})
+
+		err := writeTcpMessage(conn, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := make(map[uint16]types.ResponseCode)
+	for range ids {
+		responseBytes, err := readTcpMessage(conn, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := serde.UnmarshalPacket(responseBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		received[response.Header.ID] = response.Header.ResponseCode
+	}
+
+	expected := map[uint16]types.ResponseCode{
+		1: types.ResponseCodeNotImplemented,
+		2: types.ResponseCodeNotImplemented,
+		3: types.ResponseCodeNotImplemented,
+	}
+
+	entries := utils.Diff(received, expected)
+	if len(entries) > 0 {
+		t.Fatal(entries.String())
+	}
+}
+
+// TestTcpClientNotReading checks that a client pipelining the queries
+// without reading the responses doesn't keep the query slots forever.
+func TestTcpClientNotReading(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newServer(ctx, ServerConfig{MaxInFlight: 4, TcpIdleTimeout: 200 * time.Millisecond})
+	go s.serveTcp(ctx, listener)
+
+	records := make([]types.Record, 0, 1000)
+	for i := range 1000 {
+		records = append(records, types.Record{
+			Domain: "big.example.com.",
+			Type:   types.RecordTypeA,
+			Class:  types.RecordClassIN,
+			Ttl:    3600,
+			Data:   &types.ARData{IP: net.IPv4(10, 0, byte(i>>8), byte(i))},
+		})
+	}
+	s.cache.Set(records)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+
+	query := constructQuery("big.example.com.", types.QuestionTypeA)
+	queryBytes := mustMarshal(t, query)
+	for range 1000 {
+		err := writeTcpMessage(conn, queryBytes)
+		if err != nil {
+			break
+		}
+	}
+
+	// The slots fill up once the socket buffers do, and have to be freed
+	// when the client doesn't take the responses in time.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.inFlight) < cap(s.inFlight) {
+		if time.Now().After(deadline) {
+			t.Fatal("query slots were never filled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for len(s.inFlight) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d query slots are still held", len(s.inFlight))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestTcpHalfClose checks that the queries sent before the client closes
+// its side of the connection are still answered.
+func TestTcpHalfClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	useNameServerPort(t)
+	useRootServers(t, net.IPv4(127, 0, 0, 6))
+	startNameServer(t, net.IPv4(127, 0, 0, 6), func(query types.Packet) (types.Packet, bool) {
+		time.Sleep(100 * time.Millisecond)
+		return addressNameServer(query)
+	})
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newServer(ctx, ServerConfig{AddressPolicy: IPv4Only})
+	go s.serveTcp(ctx, listener)
+
+	conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	query := constructQuery("example.com.", types.QuestionTypeA)
+	query.Header.RecursionDesired = true
+
+	err = writeTcpMessage(conn, mustMarshal(t, query))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = conn.CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responseBytes, err := readTcpMessage(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := serde.UnmarshalPacket(responseBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Header.ResponseCode != types.ResponseCodeNoError || len(response.Records.Answers) != 1 {
+		t.Fatalf("expected an answer, got code %d with %v", response.Header.ResponseCode, response.Records.Answers)
+	}
+}
@@ -0,0 +1,43 @@
+package types
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	DefaultEdnsPayloadSize = 1232
+	EdnsVersion            = 0
+)
+
+// Extended response codes are split between the header (lower 4 bits) and
+// the OPT record (upper 8 bits), BADVERS is the only one used here.
+const ExtendedResponseCodeBadVersion = 1
+
+type EdnsOption struct {
+	Code uint16
+	Data []byte
+}
+
+// Edns is the content of the OPT pseudo-record (RFC 6891). It's kept apart
+// from the regular records, but still counts towards the size of the
+// additional section in the header.
+type Edns struct {
+	UdpPayloadSize       uint16
+	ExtendedResponseCode uint8
+	Version              uint8
+	DnssecOk             bool
+	Options              []EdnsOption
+}
+
+func (e Edns) String() string {
+	options := make([]string, 0, len(e.Options))
+	for _, option := range e.Options {
+		options = append(options, fmt.Sprintf("%d:%x", option.Code, option.Data))
+	}
+
+	return fmt.Sprintf(
+		"EDNS: version %d, payload %d, extended rcode %d, DO: %t, options: [%s]",
+		e.Version, e.UdpPayloadSize, e.ExtendedResponseCode, e.DnssecOk, strings.Join(options, ", "),
+	)
+}
@@ -2,7 +2,10 @@ package types
 
 import "fmt"
 
-const MaxPacketSize = 512
+const (
+	MaxPacketSize    = 512
+	MaxTcpPacketSize = 65535
+)
 
 type PacketRecords struct {
 	Answers           []Record
@@ -18,6 +21,20 @@ type Packet struct {
 	Header    Header
 	Questions []Question
 	Records   PacketRecords
+	Edns      *Edns
+}
+
+// UpdateSectionSizes sets the section sizes in the header according to the
+// content of the packet.
+func (p *Packet) UpdateSectionSizes() {
+	p.Header.QuestionSectionSize = uint16(len(p.Questions))
+	p.Header.AnswerSectionSize = uint16(len(p.Records.Answers))
+	p.Header.AuthorityRecordsSectionSize = uint16(len(p.Records.AuthorityRecords))
+	p.Header.AdditionalRecordsSectionSize = uint16(len(p.Records.AdditionalRecords))
+
+	if p.Edns != nil {
+		p.Header.AdditionalRecordsSectionSize += 1
+	}
 }
 
 func (p Packet) String() string {
@@ -53,5 +70,10 @@ func (p Packet) String() string {
 		bytes = append(bytes, '\n')
 	}
 
+	if p.Edns != nil {
+		bytes = append(bytes, p.Edns.String()...)
+		bytes = append(bytes, '\n')
+	}
+
 	return string(bytes)
 }
@@ -8,8 +8,12 @@ const (
 	QuestionTypeA     = QuestionType(1)
 	QuestionTypeNS    = QuestionType(2)
 	QuestionTypeCNAME = QuestionType(5)
+	QuestionTypeSOA   = QuestionType(6)
+	QuestionTypePTR   = QuestionType(12)
 	QuestionTypeMX    = QuestionType(15)
+	QuestionTypeTXT   = QuestionType(16)
 	QuestionTypeAAAA  = QuestionType(28)
+	QuestionTypeSRV   = QuestionType(33)
 )
 
 type QuestionClass uint16
@@ -12,8 +12,12 @@ func TestQuestionConstants(t *testing.T) {
 	entries = append(entries, utils.Diff(QuestionTypeA, 1)...)
 	entries = append(entries, utils.Diff(QuestionTypeNS, 2)...)
 	entries = append(entries, utils.Diff(QuestionTypeCNAME, 5)...)
+	entries = append(entries, utils.Diff(QuestionTypeSOA, 6)...)
+	entries = append(entries, utils.Diff(QuestionTypePTR, 12)...)
 	entries = append(entries, utils.Diff(QuestionTypeMX, 15)...)
+	entries = append(entries, utils.Diff(QuestionTypeTXT, 16)...)
 	entries = append(entries, utils.Diff(QuestionTypeAAAA, 28)...)
+	entries = append(entries, utils.Diff(QuestionTypeSRV, 33)...)
 
 	entries = append(entries, utils.Diff(QuestionClassIN, 1)...)
 
@@ -0,0 +1,526 @@
+package types
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/dns/io"
+)
+
+var ErrInvalidRDataLength = errors.New("invalid rdata length")
+
+// RData is the type specific part of a resource record. Implementations
+// encode and decode themselves, length is the size of the data on the wire
+// without compression.
+type RData interface {
+	Type() RecordType
+	Len() int
+	Equal(other RData) bool
+	String() string
+	Marshal(w *io.PacketWriter) error
+	Unmarshal(r *io.PacketReader, length int) error
+}
+
+type ARData struct {
+	IP net.IP
+}
+
+func (d *ARData) Type() RecordType {
+	return RecordTypeA
+}
+
+func (d *ARData) Len() int {
+	return net.IPv4len
+}
+
+func (d *ARData) Equal(other RData) bool {
+	o, ok := other.(*ARData)
+	return ok && d.IP.Equal(o.IP)
+}
+
+func (d *ARData) String() string {
+	return d.IP.String()
+}
+
+func (d *ARData) Marshal(w *io.PacketWriter) error {
+	ip := d.IP.To4()
+	if ip == nil {
+		return ErrInvalidRDataLength
+	}
+	return w.WriteBytes(ip)
+}
+
+func (d *ARData) Unmarshal(r *io.PacketReader, length int) error {
+	if length != net.IPv4len {
+		return ErrInvalidRDataLength
+	}
+
+	bytes, err := r.ReadBytes(length)
+	if err != nil {
+		return err
+	}
+
+	d.IP = append(net.IP(nil), bytes...)
+	return nil
+}
+
+type AAAARData struct {
+	IP net.IP
+}
+
+func (d *AAAARData) Type() RecordType {
+	return RecordTypeAAAA
+}
+
+func (d *AAAARData) Len() int {
+	return net.IPv6len
+}
+
+func (d *AAAARData) Equal(other RData) bool {
+	o, ok := other.(*AAAARData)
+	return ok && d.IP.Equal(o.IP)
+}
+
+func (d *AAAARData) String() string {
+	return d.IP.String()
+}
+
+func (d *AAAARData) Marshal(w *io.PacketWriter) error {
+	ip := d.IP.To16()
+	if ip == nil {
+		return ErrInvalidRDataLength
+	}
+	return w.WriteBytes(ip)
+}
+
+func (d *AAAARData) Unmarshal(r *io.PacketReader, length int) error {
+	if length != net.IPv6len {
+		return ErrInvalidRDataLength
+	}
+
+	bytes, err := r.ReadBytes(length)
+	if err != nil {
+		return err
+	}
+
+	d.IP = append(net.IP(nil), bytes...)
+	return nil
+}
+
+type NSRData struct {
+	Host string
+}
+
+func (d *NSRData) Type() RecordType {
+	return RecordTypeNS
+}
+
+func (d *NSRData) Len() int {
+	return DomainLen(d.Host)
+}
+
+func (d *NSRData) Equal(other RData) bool {
+	o, ok := other.(*NSRData)
+	return ok && strings.EqualFold(d.Host, o.Host)
+}
+
+func (d *NSRData) String() string {
+	return d.Host
+}
+
+func (d *NSRData) Marshal(w *io.PacketWriter) error {
+	return w.WriteDomain(d.Host)
+}
+
+func (d *NSRData) Unmarshal(r *io.PacketReader, length int) (err error) {
+	d.Host, err = r.ReadDomain()
+	return err
+}
+
+type CNAMERData struct {
+	Target string
+}
+
+func (d *CNAMERData) Type() RecordType {
+	return RecordTypeCNAME
+}
+
+func (d *CNAMERData) Len() int {
+	return DomainLen(d.Target)
+}
+
+func (d *CNAMERData) Equal(other RData) bool {
+	o, ok := other.(*CNAMERData)
+	return ok && strings.EqualFold(d.Target, o.Target)
+}
+
+func (d *CNAMERData) String() string {
+	return d.Target
+}
+
+func (d *CNAMERData) Marshal(w *io.PacketWriter) error {
+	return w.WriteDomain(d.Target)
+}
+
+func (d *CNAMERData) Unmarshal(r *io.PacketReader, length int) (err error) {
+	d.Target, err = r.ReadDomain()
+	return err
+}
+
+type SOARData struct {
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+func (d *SOARData) Type() RecordType {
+	return RecordTypeSOA
+}
+
+func (d *SOARData) Len() int {
+	return DomainLen(d.MName) + DomainLen(d.RName) + 5*4
+}
+
+func (d *SOARData) Equal(other RData) bool {
+	o, ok := other.(*SOARData)
+	return ok && strings.EqualFold(d.MName, o.MName) && strings.EqualFold(d.RName, o.RName) &&
+		d.Serial == o.Serial && d.Refresh == o.Refresh && d.Retry == o.Retry &&
+		d.Expire == o.Expire && d.Minimum == o.Minimum
+}
+
+func (d *SOARData) String() string {
+	return fmt.Sprintf(
+		"%s %s %d %d %d %d %d",
+		d.MName, d.RName, d.Serial, d.Refresh, d.Retry, d.Expire, d.Minimum,
+	)
+}
+
+func (d *SOARData) Marshal(w *io.PacketWriter) error {
+	err := w.WriteDomain(d.MName)
+	if err != nil {
+		return err
+	}
+
+	err = w.WriteDomain(d.RName)
+	if err != nil {
+		return err
+	}
+
+	for _, value := range []uint32{d.Serial, d.Refresh, d.Retry, d.Expire, d.Minimum} {
+		err = w.WriteUint32(value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *SOARData) Unmarshal(r *io.PacketReader, length int) (err error) {
+	d.MName, err = r.ReadDomain()
+	if err != nil {
+		return err
+	}
+
+	d.RName, err = r.ReadDomain()
+	if err != nil {
+		return err
+	}
+
+	for _, value := range []*uint32{&d.Serial, &d.Refresh, &d.Retry, &d.Expire, &d.Minimum} {
+		*value, err = r.ReadUint32()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type PTRRData struct {
+	Host string
+}
+
+func (d *PTRRData) Type() RecordType {
+	return RecordTypePTR
+}
+
+func (d *PTRRData) Len() int {
+	return DomainLen(d.Host)
+}
+
+func (d *PTRRData) Equal(other RData) bool {
+	o, ok := other.(*PTRRData)
+	return ok && strings.EqualFold(d.Host, o.Host)
+}
+
+func (d *PTRRData) String() string {
+	return d.Host
+}
+
+func (d *PTRRData) Marshal(w *io.PacketWriter) error {
+	return w.WriteDomain(d.Host)
+}
+
+func (d *PTRRData) Unmarshal(r *io.PacketReader, length int) (err error) {
+	d.Host, err = r.ReadDomain()
+	return err
+}
+
+type MXRData struct {
+	Preference uint16
+	Exchange   string
+}
+
+func (d *MXRData) Type() RecordType {
+	return RecordTypeMX
+}
+
+func (d *MXRData) Len() int {
+	return 2 + DomainLen(d.Exchange)
+}
+
+func (d *MXRData) Equal(other RData) bool {
+	o, ok := other.(*MXRData)
+	return ok && d.Preference == o.Preference && strings.EqualFold(d.Exchange, o.Exchange)
+}
+
+func (d *MXRData) String() string {
+	return fmt.Sprintf("%d %s", d.Preference, d.Exchange)
+}
+
+func (d *MXRData) Marshal(w *io.PacketWriter) error {
+	err := w.WriteUint16(d.Preference)
+	if err != nil {
+		return err
+	}
+	return w.WriteDomain(d.Exchange)
+}
+
+func (d *MXRData) Unmarshal(r *io.PacketReader, length int) (err error) {
+	d.Preference, err = r.ReadUint16()
+	if err != nil {
+		return err
+	}
+
+	d.Exchange, err = r.ReadDomain()
+	return err
+}
+
+const maxCharacterStringLength = 255
+
+var ErrCharacterStringTooLong = errors.New("character string too long")
+
+// TXTRData holds one or more character strings, each of them is at most
+// 255 bytes long (RFC 1035, section 3.3.14).
+type TXTRData struct {
+	Texts []string
+}
+
+func (d *TXTRData) Type() RecordType {
+	return RecordTypeTXT
+}
+
+func (d *TXTRData) Len() int {
+	length := 0
+	for _, text := range d.Texts {
+		length += 1 + len(text)
+	}
+	return length
+}
+
+func (d *TXTRData) Equal(other RData) bool {
+	o, ok := other.(*TXTRData)
+	if !ok || len(d.Texts) != len(o.Texts) {
+		return false
+	}
+
+	for i := range d.Texts {
+		if d.Texts[i] != o.Texts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *TXTRData) String() string {
+	texts := make([]string, 0, len(d.Texts))
+	for _, text := range d.Texts {
+		texts = append(texts, quoteCharacterString(text))
+	}
+	return strings.Join(texts, " ")
+}
+
+func (d *TXTRData) Marshal(w *io.PacketWriter) error {
+	for _, text := range d.Texts {
+		if len(text) > maxCharacterStringLength {
+			return ErrCharacterStringTooLong
+		}
+
+		err := w.WriteByte(byte(len(text)))
+		if err != nil {
+			return err
+		}
+
+		err = w.WriteBytes([]byte(text))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *TXTRData) Unmarshal(r *io.PacketReader, length int) error {
+	d.Texts = make([]string, 0)
+
+	end := r.Pos() + length
+	for r.Pos() < end {
+		size, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if r.Pos()+int(size) > end {
+			return ErrInvalidRDataLength
+		}
+
+		bytes, err := r.ReadBytes(int(size))
+		if err != nil {
+			return err
+		}
+
+		d.Texts = append(d.Texts, string(bytes))
+	}
+
+	return nil
+}
+
+// quoteCharacterString formats the string in the presentation format,
+// non-printable bytes are written as \DDD (RFC 1035, section 5.1).
+func quoteCharacterString(text string) string {
+	var builder strings.Builder
+
+	builder.WriteByte('"')
+	for i := 0; i < len(text); i++ {
+		switch b := text[i]; {
+		case b == '"' || b == '\\':
+			builder.WriteByte('\\')
+			builder.WriteByte(b)
+		case b < 0x20 || b > 0x7E:
+			fmt.Fprintf(&builder, "\\%03d", b)
+		default:
+			builder.WriteByte(b)
+		}
+	}
+	builder.WriteByte('"')
+
+	return builder.String()
+}
+
+type SRVRData struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+func (d *SRVRData) Type() RecordType {
+	return RecordTypeSRV
+}
+
+func (d *SRVRData) Len() int {
+	return 3*2 + DomainLen(d.Target)
+}
+
+func (d *SRVRData) Equal(other RData) bool {
+	o, ok := other.(*SRVRData)
+	return ok && d.Priority == o.Priority && d.Weight == o.Weight &&
+		d.Port == o.Port && strings.EqualFold(d.Target, o.Target)
+}
+
+func (d *SRVRData) String() string {
+	return fmt.Sprintf("%d %d %d %s", d.Priority, d.Weight, d.Port, d.Target)
+}
+
+func (d *SRVRData) Marshal(w *io.PacketWriter) error {
+	for _, value := range []uint16{d.Priority, d.Weight, d.Port} {
+		err := w.WriteUint16(value)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The target must not be compressed (RFC 2782).
+	return w.WriteDomainUncompressed(d.Target)
+}
+
+func (d *SRVRData) Unmarshal(r *io.PacketReader, length int) (err error) {
+	for _, value := range []*uint16{&d.Priority, &d.Weight, &d.Port} {
+		*value, err = r.ReadUint16()
+		if err != nil {
+			return err
+		}
+	}
+
+	d.Target, err = r.ReadDomain()
+	return err
+}
+
+// DomainLen returns the size of the domain on the wire without compression.
+func DomainLen(domain string) int {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return 1
+	}
+	return len(domain) + 2
+}
+
+// UnknownRData keeps the data of a record type without a dedicated
+// implementation as is, so it can be passed along unchanged (RFC 3597).
+type UnknownRData struct {
+	RecordType RecordType
+	Bytes      []byte
+}
+
+func (d *UnknownRData) Type() RecordType {
+	return d.RecordType
+}
+
+func (d *UnknownRData) Len() int {
+	return len(d.Bytes)
+}
+
+func (d *UnknownRData) Equal(other RData) bool {
+	o, ok := other.(*UnknownRData)
+	return ok && d.RecordType == o.RecordType && bytes.Equal(d.Bytes, o.Bytes)
+}
+
+func (d *UnknownRData) String() string {
+	if len(d.Bytes) == 0 {
+		return `\# 0`
+	}
+	return fmt.Sprintf(`\# %d %s`, len(d.Bytes), hex.EncodeToString(d.Bytes))
+}
+
+func (d *UnknownRData) Marshal(w *io.PacketWriter) error {
+	return w.WriteBytes(d.Bytes)
+}
+
+func (d *UnknownRData) Unmarshal(r *io.PacketReader, length int) error {
+	bytes, err := r.ReadBytes(length)
+	if err != nil {
+		return err
+	}
+
+	d.Bytes = append([]byte(nil), bytes...)
+	return nil
+}
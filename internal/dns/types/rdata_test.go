@@ -0,0 +1,64 @@
+package types
+
+import (
+	"net"
+	"testing"
+
+	"github.com/SergeyCherepiuk/dns-go/internal/utils"
+)
+
+func TestDomainLen(t *testing.T) {
+	entries := make(utils.DiffEntries, 0)
+
+	entries = append(entries, utils.Diff(DomainLen(""), 1)...)
+	entries = append(entries, utils.Diff(DomainLen("."), 1)...)
+	entries = append(entries, utils.Diff(DomainLen("com."), 5)...)
+	entries = append(entries, utils.Diff(DomainLen("example.com."), 13)...)
+	entries = append(entries, utils.Diff(DomainLen("example.com"), 13)...)
+
+	if len(entries) > 0 {
+		t.Fatal(entries.String())
+	}
+}
+
+func TestRDataEqual(t *testing.T) {
+	tests := []struct {
+		a, b     RData
+		expected bool
+	}{
+		{&ARData{IP: net.IPv4(1, 2, 3, 4)}, &ARData{IP: net.IP{1, 2, 3, 4}}, true},
+		{&ARData{IP: net.IPv4(1, 2, 3, 4)}, &ARData{IP: net.IPv4(4, 3, 2, 1)}, false},
+		{&ARData{IP: net.IPv4(1, 2, 3, 4)}, &AAAARData{IP: net.IPv4(1, 2, 3, 4)}, false},
+		{&NSRData{Host: "NS.example.com."}, &NSRData{Host: "ns.example.com."}, true},
+		{&NSRData{Host: "example.com."}, &CNAMERData{Target: "example.com."}, false},
+	}
+
+	for _, test := range tests {
+		if actual := test.a.Equal(test.b); actual != test.expected {
+			t.Errorf("%v == %v: expected %t, got %t", test.a, test.b, test.expected, actual)
+		}
+	}
+}
+
+func TestRDataString(t *testing.T) {
+	entries := make(utils.DiffEntries, 0)
+
+	entries = append(entries, utils.Diff((&ARData{IP: net.IPv4(1, 2, 3, 4)}).String(), "1.2.3.4")...)
+	entries = append(entries, utils.Diff((&AAAARData{IP: net.ParseIP("2001:db8::1")}).String(), "2001:db8::1")...)
+	entries = append(entries, utils.Diff((&NSRData{Host: "ns.example.com."}).String(), "ns.example.com.")...)
+	entries = append(entries, utils.Diff((&CNAMERData{Target: "example.com."}).String(), "example.com.")...)
+	entries = append(entries, utils.Diff((&MXRData{Preference: 10, Exchange: "mail.example.com."}).String(), "10 mail.example.com.")...)
+	entries = append(entries, utils.Diff((&PTRRData{Host: "example.com."}).String(), "example.com.")...)
+	entries = append(entries, utils.Diff((&SRVRData{Priority: 1, Weight: 2, Port: 53, Target: "ns.example.com."}).String(), "1 2 53 ns.example.com.")...)
+	entries = append(entries, utils.Diff((&TXTRData{Texts: []string{"a \"b\"", "c\\d\x01"}}).String(), `"a \"b\"" "c\\d\001"`)...)
+
+	soa := SOARData{MName: "ns.example.com.", RName: "admin.example.com.", Serial: 1, Refresh: 2, Retry: 3, Expire: 4, Minimum: 5}
+	entries = append(entries, utils.Diff(soa.String(), "ns.example.com. admin.example.com. 1 2 3 4 5")...)
+
+	entries = append(entries, utils.Diff((&UnknownRData{Bytes: []byte{0x0A, 0x00, 0x00, 0x01}}).String(), `\# 4 0a000001`)...)
+	entries = append(entries, utils.Diff((&UnknownRData{}).String(), `\# 0`)...)
+
+	if len(entries) > 0 {
+		t.Fatal(entries.String())
+	}
+}
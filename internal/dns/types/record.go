@@ -1,6 +1,9 @@
 package types
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type RecordType uint16
 
@@ -8,10 +11,35 @@ const (
 	RecordTypeA     = RecordType(1)
 	RecordTypeNS    = RecordType(2)
 	RecordTypeCNAME = RecordType(5)
+	RecordTypeSOA   = RecordType(6)
+	RecordTypePTR   = RecordType(12)
 	RecordTypeMX    = RecordType(15)
+	RecordTypeTXT   = RecordType(16)
 	RecordTypeAAAA  = RecordType(28)
+	RecordTypeSRV   = RecordType(33)
+	RecordTypeOPT   = RecordType(41)
 )
 
+var recordTypeNames = map[RecordType]string{
+	RecordTypeA:     "A",
+	RecordTypeNS:    "NS",
+	RecordTypeCNAME: "CNAME",
+	RecordTypeSOA:   "SOA",
+	RecordTypePTR:   "PTR",
+	RecordTypeMX:    "MX",
+	RecordTypeTXT:   "TXT",
+	RecordTypeAAAA:  "AAAA",
+	RecordTypeSRV:   "SRV",
+	RecordTypeOPT:   "OPT",
+}
+
+func (t RecordType) String() string {
+	if name, ok := recordTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", uint16(t))
+}
+
 type RecordClass uint16
 
 const RecordClassIN = RecordClass(1)
@@ -21,7 +49,19 @@ type Record struct {
 	Type   RecordType
 	Class  RecordClass
 	Ttl    uint32
-	Data   any
+	Data   RData
+}
+
+func (r Record) Equal(other Record) bool {
+	if !strings.EqualFold(r.Domain, other.Domain) ||
+		r.Type != other.Type || r.Class != other.Class || r.Ttl != other.Ttl {
+		return false
+	}
+
+	if r.Data == nil || other.Data == nil {
+		return r.Data == nil && other.Data == nil
+	}
+	return r.Data.Equal(other.Data)
 }
 
 func (r Record) String() string {
@@ -12,8 +12,13 @@ func TestRecordConstants(t *testing.T) {
 	entries = append(entries, utils.Diff(RecordTypeA, 1)...)
 	entries = append(entries, utils.Diff(RecordTypeNS, 2)...)
 	entries = append(entries, utils.Diff(RecordTypeCNAME, 5)...)
+	entries = append(entries, utils.Diff(RecordTypeSOA, 6)...)
+	entries = append(entries, utils.Diff(RecordTypePTR, 12)...)
 	entries = append(entries, utils.Diff(RecordTypeMX, 15)...)
+	entries = append(entries, utils.Diff(RecordTypeTXT, 16)...)
 	entries = append(entries, utils.Diff(RecordTypeAAAA, 28)...)
+	entries = append(entries, utils.Diff(RecordTypeSRV, 33)...)
+	entries = append(entries, utils.Diff(RecordTypeOPT, 41)...)
 
 	entries = append(entries, utils.Diff(RecordClassIN, 1)...)
 
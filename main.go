@@ -2,17 +2,62 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/SergeyCherepiuk/dns-go/internal/dns"
 )
 
 func main() {
-	ctx, done := context.WithCancel(context.Background())
+	ctx, done := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer done()
 
-	addr := net.UDPAddr{IP: net.IPv4(0, 0, 0, 0), Port: 4321}
-	err := dns.StartServer(ctx, addr)
-	log.Fatal(err)
+	addrs := []net.UDPAddr{
+		{IP: net.IPv4zero, Port: 4321},
+		{IP: net.IPv6unspecified, Port: 4321},
+	}
+	config := dns.ServerConfig{
+		MaxInFlight:           dns.DefaultMaxInFlight,
+		CacheSnapshotPath:     snapshotPath(),
+		CacheSnapshotInterval: 5 * time.Minute,
+		AddressPolicy:         dns.PreferIPv4,
+		LogPackets:            true,
+	}
+
+	err := dns.StartServer(ctx, addrs, config)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatal(err)
+	}
+}
+
+// snapshotPath returns the path of the cache snapshot, which can be set with
+// the DNS_GO_CACHE_SNAPSHOT environment variable and is kept in the user's
+// cache directory by default. The cache isn't persisted if neither is
+// available.
+func snapshotPath() string {
+	path, ok := os.LookupEnv("DNS_GO_CACHE_SNAPSHOT")
+	if ok {
+		return path
+	}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		log.Printf("cache won't be persisted: %v", err)
+		return ""
+	}
+
+	dir = filepath.Join(dir, "dns-go")
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		log.Printf("cache won't be persisted: %v", err)
+		return ""
+	}
+
+	return filepath.Join(dir, "cache.snapshot")
 }